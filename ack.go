@@ -0,0 +1,138 @@
+package brts
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAckDisabled = errors.New("brts: acknowledgements are not enabled")
+	ErrAckTimeout  = errors.New("brts: message was not acknowledged")
+)
+
+// acker matches a client's ACK frames to the sends waiting for them, oldest
+// first.
+type acker struct {
+	mu        *sync.Mutex
+	frame     []byte
+	retries   int
+	onFailure func(c *Client, data []byte)
+	waiting   []chan error
+	closed    bool
+}
+
+func (s *Server) newAcker() *acker {
+	if s.ackFrame == nil {
+		return nil
+	}
+	return &acker{
+		mu:        &sync.Mutex{},
+		frame:     s.ackFrame,
+		retries:   s.ackRetries,
+		onFailure: s.onAckFailure,
+	}
+}
+
+func (a *acker) wait() (chan error, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, ErrClientGone
+	}
+	acked := make(chan error, 1)
+	a.waiting = append(a.waiting, acked)
+	return acked, nil
+}
+
+// cancel stops waiting for an acknowledgement. It reports false when the
+// acknowledgement arrived meanwhile.
+func (a *acker) cancel(acked chan error) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i := slices.Index(a.waiting, acked)
+	if i < 0 {
+		return false
+	}
+	a.waiting = slices.Delete(a.waiting, i, i+1)
+	return true
+}
+
+// takeAck resolves the oldest waiting send when frame is an ACK, either bare
+// or framed the way the client's messages are.
+func (c *Client) takeAck(frame []byte) bool {
+	a := c.acks
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.waiting) == 0 {
+		return false
+	}
+	if !bytes.Equal(frame, a.frame) {
+		framer := c.sendFramer()
+		if framer == nil {
+			return false
+		}
+		ack, err := encodeFrame(framer, nil, a.frame)
+		if err != nil || !bytes.Equal(frame, ack) {
+			return false
+		}
+	}
+	a.waiting[0] <- nil
+	a.waiting = a.waiting[1:]
+	return true
+}
+
+// close fails the sends still waiting once the client is gone.
+func (a *acker) close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.closed = true
+	for _, acked := range a.waiting {
+		acked <- ErrClientGone
+	}
+	a.waiting = nil
+}
+
+// SendWithAck sends data like Send and waits up to timeout for the peer to
+// answer with the ACK frame set by WithAck, sending it again as many times
+// as configured. ACKs resolve waiting sends in the order they were sent and
+// are not passed to the handlers. When every attempt times out, OnAckFailure
+// is called and ErrAckTimeout returned.
+func (c *Client) SendWithAck(data []byte, timeout time.Duration) error {
+	a := c.acks
+	if a == nil {
+		return ErrAckDisabled
+	}
+
+	for attempt := 0; attempt <= a.retries; attempt++ {
+		acked, err := a.wait()
+		if err != nil {
+			return err
+		}
+		if err := c.Send(data); err != nil {
+			a.cancel(acked)
+			return err
+		}
+
+		timer := time.NewTimer(timeout)
+		select {
+		case err := <-acked:
+			timer.Stop()
+			return err
+		case <-timer.C:
+			if !a.cancel(acked) {
+				return <-acked
+			}
+		}
+	}
+	a.onFailure(c, data)
+	return ErrAckTimeout
+}
+
+// OnAckFailure is called with the data of a SendWithAck that was not
+// acknowledged after all its attempts.
+func (s *Server) OnAckFailure(callback func(c *Client, data []byte)) {
+	s.onAckFailure = callback
+}
@@ -0,0 +1,110 @@
+package brts
+
+import (
+	"errors"
+	"time"
+)
+
+// AuthTimeoutReason is the CloseReason of clients disconnected for not
+// authenticating in time.
+const AuthTimeoutReason = "authentication timeout"
+
+var (
+	ErrAuthState   = errors.New("brts: invalid authentication state change")
+	ErrAuthTimeout = errors.New("brts: authentication timeout")
+)
+
+// AuthState is how far a client got authenticating. It only moves forward.
+type AuthState int
+
+const (
+	Unauthenticated AuthState = iota
+	Authenticating
+	Authenticated
+)
+
+func (a AuthState) String() string {
+	switch a {
+	case Authenticating:
+		return "authenticating"
+	case Authenticated:
+		return "authenticated"
+	default:
+		return "unauthenticated"
+	}
+}
+
+// startAuthTimer disconnects the client once the server's authentication
+// deadline passes without it authenticating.
+func (s *Server) startAuthTimer(c *Client) {
+	if s.authTimeout <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.authTimer = time.AfterFunc(s.authTimeout, func() {
+		c.mu.Lock()
+		expired := c.auth != Authenticated
+		if expired {
+			c.reason = AuthTimeoutReason
+		}
+		c.mu.Unlock()
+		if expired {
+			s.logger.Printf("authentication timeout: %v", c.Conn.RemoteAddr())
+			s.onError(c, &TimeoutError{Err: ErrAuthTimeout})
+			c.Close()
+		}
+	})
+}
+
+func (c *Client) stopAuthTimer() {
+	c.mu.Lock()
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	c.mu.Unlock()
+}
+
+// AuthState reports how far the client got authenticating.
+func (c *Client) AuthState() AuthState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.auth
+}
+
+// BeginAuth marks an unauthenticated client as authenticating, such as
+// after a challenge was sent to it. It does not extend the deadline set
+// with WithAuthDeadline.
+func (c *Client) BeginAuth() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.auth != Unauthenticated {
+		return ErrAuthState
+	}
+	c.auth = Authenticating
+	return nil
+}
+
+// Authenticate marks the client as authenticated, which stops its
+// authentication deadline, and calls OnAuthenticated. A client can be
+// authenticated once.
+func (c *Client) Authenticate() error {
+	c.mu.Lock()
+	if c.auth == Authenticated {
+		c.mu.Unlock()
+		return ErrAuthState
+	}
+	c.auth = Authenticated
+	if c.authTimer != nil {
+		c.authTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	c.onAuthed(c)
+	return nil
+}
+
+// OnAuthenticated is called when a client is authenticated.
+func (s *Server) OnAuthenticated(callback func(c *Client)) {
+	s.onAuthenticated = callback
+}
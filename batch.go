@@ -0,0 +1,103 @@
+package brts
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultBatchInterval = 100 * time.Millisecond
+)
+
+// batcher collects a client's messages for OnMessageBatch and hands them
+// over once size messages are waiting or interval has passed since the
+// first of them arrived.
+type batcher struct {
+	c        *Client
+	handler  func(c *Client, msgs [][]byte)
+	size     int
+	interval time.Duration
+
+	mu      *sync.Mutex
+	sending *sync.Mutex
+	msgs    [][]byte
+	timer   *time.Timer
+	closed  bool
+}
+
+func (s *Server) newBatcher(c *Client) *batcher {
+	if s.onMessageBatch == nil {
+		return nil
+	}
+	b := &batcher{
+		c:        c,
+		handler:  s.onMessageBatch,
+		size:     s.batchSize,
+		interval: s.batchDelay,
+		mu:       &sync.Mutex{},
+		sending:  &sync.Mutex{},
+	}
+	if b.size == 0 && b.interval == 0 {
+		b.size = defaultBatchSize
+		b.interval = defaultBatchInterval
+	}
+	return b
+}
+
+func (b *batcher) add(msg []byte) {
+	b.mu.Lock()
+	b.msgs = append(b.msgs, msg)
+	if b.size > 0 && len(b.msgs) >= b.size {
+		b.flushUnlock()
+		return
+	}
+	if len(b.msgs) == 1 && b.interval > 0 {
+		b.timer = time.AfterFunc(b.interval, b.flush)
+	}
+	b.mu.Unlock()
+}
+
+func (b *batcher) flush() {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return
+	}
+	b.flushUnlock()
+}
+
+// flushUnlock takes the pending messages, releases b.mu and dispatches
+// them, so a handler run inline does not hold up the read loop. b.sending
+// is taken before b.mu is released to keep batches in order between the
+// read loop and the timer.
+func (b *batcher) flushUnlock() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	msgs := b.msgs
+	b.msgs = nil
+	if len(msgs) == 0 {
+		b.mu.Unlock()
+		return
+	}
+
+	b.sending.Lock()
+	b.mu.Unlock()
+	defer b.sending.Unlock()
+	b.c.dispatch(func() {
+		b.handler(b.c, msgs)
+	})
+}
+
+// close delivers whatever is still pending when the connection ends.
+func (b *batcher) close() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	b.closed = true
+	b.flushUnlock()
+}
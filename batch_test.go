@@ -0,0 +1,35 @@
+package brts
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatchHandlerDoesNotBlockAdd(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	b := &batcher{
+		c: &Client{mu: &sync.Mutex{}},
+		handler: func(c *Client, msgs [][]byte) {
+			if string(msgs[0]) == "first" {
+				close(started)
+				<-release
+			}
+		},
+		interval: time.Millisecond,
+		mu:       &sync.Mutex{},
+		sending:  &sync.Mutex{},
+	}
+	defer close(release)
+
+	// Without workers the timer runs the handler inline.
+	b.add([]byte("first"))
+	waitFor(t, started, "the first batch")
+	added := make(chan struct{})
+	go func() {
+		b.add([]byte("second"))
+		close(added)
+	}()
+	waitFor(t, added, "add while the handler runs")
+}
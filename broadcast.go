@@ -0,0 +1,140 @@
+package brts
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// BroadcastError reports the clients a broadcast could not be sent to.
+type BroadcastError struct {
+	Failed map[*Client]error
+}
+
+// Error describes the failure of the client that connected first, so the
+// message does not change between calls.
+func (e *BroadcastError) Error() string {
+	clients := e.clients()
+	if len(clients) == 0 {
+		return "brts: broadcast failed"
+	}
+	c := clients[0]
+	if len(clients) == 1 {
+		return fmt.Sprintf("brts: broadcast to %v failed: %v", c.Conn.RemoteAddr(), e.Failed[c])
+	}
+	return fmt.Sprintf("brts: broadcast failed for %d clients, %v: %v", len(clients), c.Conn.RemoteAddr(), e.Failed[c])
+}
+
+// Unwrap returns the errors in the order the clients connected.
+func (e *BroadcastError) Unwrap() []error {
+	clients := e.clients()
+	errs := make([]error, 0, len(clients))
+	for _, c := range clients {
+		errs = append(errs, e.Failed[c])
+	}
+	return errs
+}
+
+func (e *BroadcastError) clients() []*Client {
+	clients := make([]*Client, 0, len(e.Failed))
+	for c := range e.Failed {
+		clients = append(clients, c)
+	}
+	slices.SortFunc(clients, func(a, b *Client) int { return cmp.Compare(a.id, b.id) })
+	return clients
+}
+
+// Broadcast sends data to every connected client, framed as Send frames it.
+// Clients are written to concurrently, a bounded number at a time and each
+// for at most DefaultBroadcastTimeout; the ones that fail are reported in a
+// *BroadcastError.
+func (s *Server) Broadcast(data []byte) error {
+	return s.broadcast(context.Background(), s.readyClients(), data)
+}
+
+// BroadcastContext sends data like Broadcast, giving up on the clients not
+// written to when ctx ends.
+func (s *Server) BroadcastContext(ctx context.Context, data []byte) error {
+	return s.broadcast(ctx, s.readyClients(), data)
+}
+
+// BroadcastFunc sends data like Broadcast, to the clients filter accepts.
+// filter is called once per client and may run concurrently with the
+// client's callbacks.
+func (s *Server) BroadcastFunc(data []byte, filter func(c *Client) bool) error {
+	clients := s.readyClients()
+	selected := clients[:0]
+	for _, c := range clients {
+		if filter(c) {
+			selected = append(selected, c)
+		}
+	}
+	return s.broadcast(context.Background(), selected, data)
+}
+
+// BroadcastExcept sends data like Broadcast to every client but sender,
+// typically the client whose message is being relayed.
+func (s *Server) BroadcastExcept(data []byte, sender *Client) error {
+	return s.BroadcastFunc(data, func(c *Client) bool { return c != sender })
+}
+
+// readyClients returns the clients OnNewConnection has been called for.
+func (s *Server) readyClients() []*Client {
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	return onlyReady(clients)
+}
+
+func onlyReady(clients []*Client) []*Client {
+	ready := clients[:0]
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.ready {
+			ready = append(ready, c)
+		}
+		c.mu.Unlock()
+	}
+	return ready
+}
+
+// broadcastWorkers is how many clients a broadcast writes to at a time.
+const broadcastWorkers = 64
+
+func (s *Server) broadcast(ctx context.Context, clients []*Client, data []byte) error {
+	mu := &sync.Mutex{}
+	failed := make(map[*Client]error)
+	next := make(chan *Client)
+	wg := &sync.WaitGroup{}
+	for range min(len(clients), broadcastWorkers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range next {
+				ctx, cancel := context.WithTimeout(ctx, DefaultBroadcastTimeout)
+				err := c.SendContext(ctx, data)
+				cancel()
+				if err != nil {
+					mu.Lock()
+					failed[c] = err
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, c := range clients {
+		next <- c
+	}
+	close(next)
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &BroadcastError{Failed: failed}
+	}
+	return nil
+}
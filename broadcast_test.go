@@ -0,0 +1,23 @@
+package brts
+
+import "testing"
+
+func TestBroadcastManyClients(t *testing.T) {
+	s := newServer(t)
+	connected := make(chan *Client, broadcastWorkers*2)
+	s.OnNewConnection(func(c *Client) { connected <- c })
+	start(t, s)
+
+	// More clients than the broadcast writes to at a time.
+	conns := make([]*testConn, broadcastWorkers*2)
+	for i := range conns {
+		conns[i] = dial(t, s)
+		receive(t, connected)
+	}
+	if err := s.Broadcast([]byte("hello")); err != nil {
+		t.Fatalf("Broadcast: %v", err)
+	}
+	for _, conn := range conns {
+		conn.expect(t, "hello")
+	}
+}
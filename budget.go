@@ -0,0 +1,95 @@
+package brts
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrMemoryBudget    = errors.New("brts: client exceeded its queued bytes budget")
+	ErrGoroutineBudget = errors.New("brts: client exceeded its goroutine budget")
+)
+
+// clientBudget limits the resources one client may hold. Zero leaves a
+// limit off.
+type clientBudget struct {
+	queued     int
+	goroutines int
+}
+
+// charge adds n bytes to the client's queued inbound messages. It reports
+// false once the client is over its budget, after disconnecting it.
+func (c *Client) charge(n int) bool {
+	if c.budget.queued <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	c.inbound += n
+	c.mu.Unlock()
+	return n <= 0 || c.withinBudget()
+}
+
+// withinBudget checks the bytes queued in both directions against the
+// client's budget and disconnects the client when they exceed it.
+func (c *Client) withinBudget() bool {
+	c.mu.Lock()
+	inbound, q := c.inbound, c.queue
+	c.mu.Unlock()
+
+	outbound := 0
+	if q != nil {
+		q.mu.Lock()
+		outbound = q.size
+		q.mu.Unlock()
+	}
+	if inbound+outbound <= c.budget.queued {
+		return true
+	}
+	c.exceed(ErrMemoryBudget)
+	return false
+}
+
+// exceed disconnects a client that went over its budget and reports it,
+// once.
+func (c *Client) exceed(err error) {
+	c.mu.Lock()
+	first := !c.exceeded
+	c.exceeded = true
+	c.mu.Unlock()
+	if first {
+		c.Close()
+		c.onExceeded(c, err)
+	}
+}
+
+// Go runs fn on a goroutine of its own with the client's context, counted
+// against the client's goroutine budget. A client already running as many
+// goroutines as its budget allows is disconnected instead, and
+// ErrGoroutineBudget returned.
+func (c *Client) Go(fn func(ctx context.Context)) error {
+	c.mu.Lock()
+	if c.budget.goroutines > 0 && c.goroutines >= c.budget.goroutines {
+		c.mu.Unlock()
+		c.exceed(ErrGoroutineBudget)
+		return ErrGoroutineBudget
+	}
+	c.goroutines++
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			c.goroutines--
+			c.mu.Unlock()
+		}()
+		fn(c.ctx)
+	}()
+	return nil
+}
+
+// OnBudgetExceeded is called after a client was disconnected for going over
+// the budget set with WithClientBudget, with ErrMemoryBudget or
+// ErrGoroutineBudget.
+func (s *Server) OnBudgetExceeded(callback func(c *Client, err error)) {
+	s.onOverBudget = callback
+}
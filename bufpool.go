@@ -0,0 +1,50 @@
+package brts
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+const minReadBufferSize = 4096
+
+// Read buffers are pooled by size class, a power of two of at least
+// minReadBufferSize, and handed back when a connection closes.
+var readerPools sync.Map
+
+var datagramPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, maxDatagramSize)
+		return &buf
+	},
+}
+
+func readerClass(size int) int {
+	class := minReadBufferSize
+	for class < size {
+		class <<= 1
+	}
+	return class
+}
+
+func readerPool(class int) *sync.Pool {
+	if pool, ok := readerPools.Load(class); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := readerPools.LoadOrStore(class, &sync.Pool{})
+	return pool.(*sync.Pool)
+}
+
+func getReader(r io.Reader, size int) *bufio.Reader {
+	class := readerClass(size)
+	if br, ok := readerPool(class).Get().(*bufio.Reader); ok {
+		br.Reset(r)
+		return br
+	}
+	return bufio.NewReaderSize(r, class)
+}
+
+func putReader(br *bufio.Reader) {
+	br.Reset(nil)
+	readerPool(br.Size()).Put(br)
+}
@@ -0,0 +1,564 @@
+package brts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrCBOR = errors.New("brts: malformed cbor")
+
+// cborMaxDepth bounds the nesting of arrays, maps and tags.
+const cborMaxDepth = 256
+
+const cborIndefinite = 31
+
+// CBORTag is a tagged value the decoder does not interpret. Tags 0 and 1
+// are decoded as time.Time.
+type CBORTag struct {
+	Number  uint64
+	Content any
+}
+
+// CBORSimple is a simple value other than false, true, null and undefined.
+type CBORSimple uint8
+
+var cborSimpleType = reflect.TypeOf(CBORSimple(0))
+
+// CBORCodec reads one CBOR data item (RFC 8949) per message, including items
+// of indefinite length, which are followed until their break. Decode returns
+// the generic form: uint64, int64, float32, float64, bool, nil, string,
+// []byte, []any, map[string]any (map[any]any when keys are not all strings),
+// time.Time, CBORTag or CBORSimple. Unmarshal and Marshal plug in a library
+// for typed values, New supplying the value to unmarshal into. A non-zero
+// MaxLength rejects longer messages with ErrFrameTooLarge.
+type CBORCodec struct {
+	MaxLength int
+	New       func() any
+	Unmarshal func(data []byte, v any) error
+	Marshal   func(v any) ([]byte, error)
+}
+
+func (c CBORCodec) ReadFrame(r io.Reader) ([]byte, error) {
+	return c.AppendFrame(nil, r)
+}
+
+// AppendFrame appends the bytes of the next complete data item. It keeps a
+// stack of how many items each open array, map or tag still holds, -1 for
+// those of indefinite length.
+func (c CBORCodec) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	start := len(dst)
+	read := func(n uint64) ([]byte, error) {
+		if c.MaxLength > 0 && uint64(len(dst)-start)+n > uint64(c.MaxLength) {
+			return nil, ErrFrameTooLarge
+		}
+		if n > math.MaxInt32 {
+			return nil, ErrFrameTooLarge
+		}
+		var err error
+		if dst, err = readFull(dst, r, int(n)); err != nil {
+			if len(dst) > start || err != io.EOF {
+				err = unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		return dst[len(dst)-int(n):], nil
+	}
+
+	open := []int64{1}
+	for {
+		for len(open) > 0 && open[len(open)-1] == 0 {
+			open = open[:len(open)-1]
+		}
+		if len(open) == 0 {
+			return dst, nil
+		}
+		if len(open) > cborMaxDepth {
+			return dst[:start], fmt.Errorf("%w: nested too deeply", ErrCBOR)
+		}
+
+		head, err := read(1)
+		if err != nil {
+			return dst[:start], err
+		}
+		top := &open[len(open)-1]
+		if head[0] == 0xff {
+			if *top != -1 {
+				return dst[:start], fmt.Errorf("%w: unexpected break", ErrCBOR)
+			}
+			open = open[:len(open)-1]
+			continue
+		}
+		if *top > 0 {
+			*top--
+		}
+
+		major, info := head[0]>>5, head[0]&0x1f
+		var arg uint64
+		switch {
+		case info < 24:
+			arg = uint64(info)
+		case info <= 27:
+			b, err := read(1 << (info - 24))
+			if err != nil {
+				return dst[:start], err
+			}
+			arg = msgpackUint(b)
+		case info == cborIndefinite && major >= 2 && major <= 5:
+			open = append(open, -1)
+			continue
+		default:
+			return dst[:start], fmt.Errorf("%w: invalid additional information %d", ErrCBOR, info)
+		}
+
+		if (major == 4 || major == 5) && arg > math.MaxInt32 {
+			return dst[:start], ErrFrameTooLarge
+		}
+		switch major {
+		case 2, 3:
+			if _, err := read(arg); err != nil {
+				return dst[:start], err
+			}
+		case 4:
+			open = append(open, int64(arg))
+		case 5:
+			open = append(open, 2*int64(arg))
+		case 6:
+			open = append(open, 1)
+		}
+	}
+}
+
+// EncodeFrame writes payload as it is: encoded values delimit themselves.
+func (c CBORCodec) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return append(dst, payload...), nil
+}
+
+func (c CBORCodec) Decode(data []byte) (any, error) {
+	if c.New != nil && c.Unmarshal != nil {
+		v := c.New()
+		if err := c.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return UnmarshalCBOR(data)
+}
+
+func (c CBORCodec) Encode(v any) ([]byte, error) {
+	if c.Marshal != nil {
+		return c.Marshal(v)
+	}
+	return AppendCBOR(nil, v)
+}
+
+// UnmarshalCBOR decodes a single CBOR data item into its generic form.
+func UnmarshalCBOR(data []byte) (any, error) {
+	d := &cborDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrCBOR, len(data)-d.pos)
+	}
+	return v, nil
+}
+
+// cborBreak is returned by value for the break that ends an indefinite
+// length item.
+var cborBreak = fmt.Errorf("%w: unexpected break", ErrCBOR)
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *cborDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// head reads an item's initial byte and its argument.
+func (d *cborDecoder) head() (major byte, info byte, arg uint64, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), nil
+	case info <= 27:
+		b, err := d.next(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		return major, info, msgpackUint(b), nil
+	case info == cborIndefinite:
+		return major, info, 0, nil
+	}
+	return 0, 0, 0, fmt.Errorf("%w: invalid additional information %d", ErrCBOR, info)
+}
+
+func (d *cborDecoder) value(depth int) (any, error) {
+	if depth > cborMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrCBOR)
+	}
+	major, info, arg, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+
+	switch major {
+	case 0:
+		if indefinite {
+			break
+		}
+		return arg, nil
+	case 1:
+		if indefinite {
+			break
+		}
+		if arg > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: negative integer out of range", ErrCBOR)
+		}
+		return -1 - int64(arg), nil
+	case 2, 3:
+		b, err := d.str(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == 3 {
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		return d.array(arg, indefinite, depth)
+	case 5:
+		return d.mapValue(arg, indefinite, depth)
+	case 6:
+		if indefinite {
+			break
+		}
+		content, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return cborTagged(arg, content)
+	case 7:
+		return d.simple(info, arg)
+	}
+	return nil, fmt.Errorf("%w: invalid indefinite length", ErrCBOR)
+}
+
+// str reads a byte or text string; one of indefinite length is a series of
+// definite chunks of the same type ended by a break.
+func (d *cborDecoder) str(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		b, err := d.next(n)
+		return append([]byte{}, b...), err
+	}
+
+	buf := []byte{}
+	for {
+		chunkMajor, info, n, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor == 7 && info == cborIndefinite {
+			return buf, nil
+		}
+		if chunkMajor != major || info == cborIndefinite {
+			return nil, fmt.Errorf("%w: invalid string chunk", ErrCBOR)
+		}
+		b, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, b...)
+	}
+}
+
+func (d *cborDecoder) array(n uint64, indefinite bool, depth int) (any, error) {
+	if !indefinite && n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+	}
+	list := make([]any, 0, n)
+	for i := uint64(0); indefinite || i < n; i++ {
+		v, err := d.value(depth + 1)
+		if err == cborBreak && indefinite {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+func (d *cborDecoder) mapValue(n uint64, indefinite bool, depth int) (any, error) {
+	if !indefinite && n > uint64(len(d.data)-d.pos)/2 {
+		return nil, fmt.Errorf("%w: unexpected end", ErrCBOR)
+	}
+	var keys, values []any
+	strs := true
+	for i := uint64(0); indefinite || i < n; i++ {
+		k, err := d.value(depth + 1)
+		if err == cborBreak && indefinite {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch key := k.(type) {
+		case string:
+		case []byte:
+			k = string(key)
+			strs = false
+		case []any, map[string]any, map[any]any, CBORTag:
+			return nil, fmt.Errorf("%w: unhashable map key", ErrCBOR)
+		default:
+			strs = false
+		}
+		keys = append(keys, k)
+		values = append(values, v)
+	}
+
+	if strs {
+		m := make(map[string]any, len(keys))
+		for i, k := range keys {
+			m[k.(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[any]any, len(keys))
+	for i, k := range keys {
+		m[k] = values[i]
+	}
+	return m, nil
+}
+
+func (d *cborDecoder) simple(info byte, arg uint64) (any, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		return halfToFloat(uint16(arg)), nil
+	case 26:
+		return math.Float32frombits(uint32(arg)), nil
+	case 27:
+		return math.Float64frombits(arg), nil
+	case cborIndefinite:
+		return nil, cborBreak
+	}
+	return CBORSimple(arg), nil
+}
+
+func cborTagged(number uint64, content any) (any, error) {
+	switch number {
+	case 0:
+		if s, ok := content.(string); ok {
+			return time.Parse(time.RFC3339Nano, s)
+		}
+	case 1:
+		switch v := content.(type) {
+		case uint64:
+			return time.Unix(int64(v), 0), nil
+		case int64:
+			return time.Unix(v, 0), nil
+		case float32:
+			return floatTime(float64(v)), nil
+		case float64:
+			return floatTime(v), nil
+		}
+	}
+	return CBORTag{Number: number, Content: content}, nil
+}
+
+func floatTime(f float64) time.Time {
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
+
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
+
+// AppendCBOR appends the CBOR encoding of v. It handles the values
+// UnmarshalCBOR returns, other integer and float types, slices, arrays, maps
+// and structs; struct fields are named by their cbor tag or field name, and
+// a tag of "-" skips the field. Times are written as RFC 3339 strings with
+// tag 0.
+func AppendCBOR(dst []byte, v any) ([]byte, error) {
+	return appendCBORValue(dst, reflect.ValueOf(v), 0)
+}
+
+func appendCBORValue(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	if depth > cborMaxDepth {
+		return dst, fmt.Errorf("brts: cbor value nested too deeply")
+	}
+	if v.IsValid() && v.Type() == cborSimpleType {
+		return appendCBORHead(dst, 7, v.Uint()), nil
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(dst, 0xf6), nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(dst, 0xf6), nil
+		}
+		return appendCBORValue(dst, v.Elem(), depth+1)
+	case reflect.Bool:
+		if v.Bool() {
+			return append(dst, 0xf5), nil
+		}
+		return append(dst, 0xf4), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n := v.Int(); n < 0 {
+			return appendCBORHead(dst, 1, uint64(-1-n)), nil
+		}
+		return appendCBORHead(dst, 0, uint64(v.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendCBORHead(dst, 0, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xfa), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(dst, 0xfb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return append(appendCBORHead(dst, 3, uint64(v.Len())), v.String()...), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(dst, 0xf6), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return append(appendCBORHead(dst, 2, uint64(len(b))), b...), nil
+		}
+		dst = appendCBORHead(dst, 4, uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if dst, err = appendCBORValue(dst, v.Index(i), depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(dst, 0xf6), nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		dst = appendCBORHead(dst, 5, uint64(len(keys)))
+		for _, k := range keys {
+			var err error
+			if dst, err = appendCBORValue(dst, k, depth+1); err != nil {
+				return dst, err
+			}
+			if dst, err = appendCBORValue(dst, v.MapIndex(k), depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case reflect.Struct:
+		switch sv := v.Interface().(type) {
+		case time.Time:
+			s := sv.Format(time.RFC3339Nano)
+			return append(appendCBORHead(appendCBORHead(dst, 6, 0), 3, uint64(len(s))), s...), nil
+		case CBORTag:
+			return appendCBORValue(appendCBORHead(dst, 6, sv.Number), reflect.ValueOf(sv.Content), depth+1)
+		}
+		return appendCBORStruct(dst, v, depth)
+	}
+	return dst, fmt.Errorf("brts: can not encode %s as cbor", v.Type())
+}
+
+func appendCBORStruct(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	t := v.Type()
+	var names []string
+	var fields []reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("cbor"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		names = append(names, name)
+		fields = append(fields, v.Field(i))
+	}
+
+	dst = appendCBORHead(dst, 5, uint64(len(names)))
+	for i, name := range names {
+		dst = append(appendCBORHead(dst, 3, uint64(len(name))), name...)
+		var err error
+		if dst, err = appendCBORValue(dst, fields[i], depth+1); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// appendCBORHead appends an initial byte and its argument in the shortest
+// form.
+func appendCBORHead(dst []byte, major byte, arg uint64) []byte {
+	major <<= 5
+	switch {
+	case arg < 24:
+		return append(dst, major|byte(arg))
+	case arg <= math.MaxUint8:
+		return append(dst, major|24, byte(arg))
+	case arg <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, major|25), uint16(arg))
+	case arg <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, major|26), uint32(arg))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, major|27), arg)
+	}
+}
@@ -0,0 +1,177 @@
+package brts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"slices"
+)
+
+var ErrInvalidChecksum = errors.New("brts: invalid checksum")
+
+// InvalidFrameError is returned by a framer for a frame that was read in full
+// but failed validation. The connection stays open: the frame is reported to
+// OnInvalidFrame instead of the message handlers. Frame may share the
+// framer's buffer.
+type InvalidFrameError struct {
+	Frame []byte
+	Err   error
+}
+
+func (e *InvalidFrameError) Error() string {
+	return "brts: invalid frame: " + e.Err.Error()
+}
+
+func (e *InvalidFrameError) Unwrap() error {
+	return e.Err
+}
+
+// Checksum verifies a frame that ends with its check value and returns the
+// payload without it.
+type Checksum interface {
+	Verify(frame []byte) ([]byte, bool)
+}
+
+// ChecksumFunc adapts an ordinary function to the Checksum interface.
+type ChecksumFunc func(frame []byte) ([]byte, bool)
+
+func (f ChecksumFunc) Verify(frame []byte) ([]byte, bool) {
+	return f(frame)
+}
+
+// Built-in checksums. CRC16CCITT (CCITT-FALSE) and CRC32 (IEEE) are sent big
+// endian, CRC16Modbus little endian as Modbus RTU does; XORChecksum is a
+// single byte XOR of the payload.
+var (
+	CRC16CCITT  Checksum = trailingSum{size: 2, sum: crc16CCITT}
+	CRC16Modbus Checksum = trailingSum{size: 2, sum: crc16Modbus}
+	CRC32       Checksum = trailingSum{size: 4, sum: crc32IEEE}
+	XORChecksum Checksum = trailingSum{size: 1, sum: xorSum}
+)
+
+type trailingSum struct {
+	size int
+	sum  func(dst, data []byte) []byte
+}
+
+func (t trailingSum) Verify(frame []byte) ([]byte, bool) {
+	if len(frame) < t.size {
+		return nil, false
+	}
+	payload := frame[:len(frame)-t.size]
+	var buf [4]byte
+	return payload, bytes.Equal(t.sum(buf[:0], payload), frame[len(payload):])
+}
+
+type checksumAppender interface {
+	Append(dst, payload []byte) []byte
+}
+
+// Append appends payload and its check value.
+func (t trailingSum) Append(dst, payload []byte) []byte {
+	return t.sum(append(dst, payload...), payload)
+}
+
+func crc16CCITT(dst, data []byte) []byte {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return binary.BigEndian.AppendUint16(dst, crc)
+}
+
+func crc16Modbus(dst, data []byte) []byte {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return binary.LittleEndian.AppendUint16(dst, crc)
+}
+
+func crc32IEEE(dst, data []byte) []byte {
+	return binary.BigEndian.AppendUint32(dst, crc32.ChecksumIEEE(data))
+}
+
+func xorSum(dst, data []byte) []byte {
+	var sum byte
+	for _, b := range data {
+		sum ^= b
+	}
+	return append(dst, sum)
+}
+
+// ChecksumFramer validates the frames of another framer. The check value is
+// the tail of the frame Framer returns, so delimited framers should strip
+// their delimiter. Frames that fail are returned as an *InvalidFrameError.
+type ChecksumFramer struct {
+	Framer   Framer
+	Checksum Checksum
+}
+
+func (f ChecksumFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f ChecksumFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	start := len(dst)
+	data, err := appendFrame(f.Framer, dst, r, false)
+	if err != nil {
+		return data, err
+	}
+
+	frame := data[start:]
+	payload, ok := f.Checksum.Verify(frame)
+	if !ok {
+		return data[:start], &InvalidFrameError{Frame: frame, Err: ErrInvalidChecksum}
+	}
+	return append(data[:start], payload...), nil
+}
+
+// EncodeFrame appends the check value and frames the result with Framer.
+// The checksum must be one of the built-ins or implement
+// Append(dst, payload []byte) []byte.
+func (f ChecksumFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	sum, ok := f.Checksum.(checksumAppender)
+	if !ok {
+		return dst, ErrFramingUnsupported
+	}
+	return encodeFrame(f.Framer, dst, sum.Append(nil, payload))
+}
+
+// invalidFrame reports a frame that failed validation and answers it with
+// the NACK response, if one is set. Both run in order with the client's
+// message callbacks.
+func (s *Server) invalidFrame(c *Client, err *InvalidFrameError) {
+	frame := slices.Clone(err.Frame)
+	c.dispatch(func() {
+		s.onInvalidFrame(c, frame, err.Err)
+		s.onError(c, &FramingError{Err: err})
+		if s.nackMessage != nil {
+			if _, werr := c.Write(s.nackMessage); werr != nil {
+				s.logger.Printf("Error %s: %v", c.Conn.RemoteAddr(), werr)
+			}
+		}
+	})
+}
+
+// OnInvalidFrame is called for each frame that fails validation, instead of
+// the message callbacks.
+func (s *Server) OnInvalidFrame(callback func(c *Client, frame []byte, err error)) {
+	s.onInvalidFrame = callback
+}
@@ -0,0 +1,290 @@
+package brts
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+var ErrVarintOverflow = errors.New("brts: varint overflows a 64-bit integer")
+
+// Decoder turns a framed message into a value for OnDecoded. A decoder that
+// is also a Framer frames the messages it decodes.
+type Decoder interface {
+	Decode(data []byte) (any, error)
+}
+
+// Codec frames messages and decodes them into values of type T. The
+// built-in codecs decode into any; Typed narrows them to the type they were
+// set up to produce.
+type Codec[T any] interface {
+	Framer
+	Decode(data []byte) (T, error)
+}
+
+// Validator is implemented by decoded values that can check themselves.
+// Handle rejects values that fail validation as decode errors.
+type Validator interface {
+	Validate() error
+}
+
+// Handle frames the server's messages with codec and passes each decoded
+// value to fn. Messages that fail to decode or validate go to OnDecodeError.
+// It replaces the server's framing and decoder, keeps an encoder set with
+// WithEncoder, and must be called before the server is started.
+func Handle[T any](s *Server, codec Codec[T], fn func(c *Client, msg T)) {
+	s.framer = codec
+	s.decoder = typedDecoder[T]{codec: codec}
+	if encoder, ok := codec.(Encoder); ok && s.encoder == nil {
+		s.encoder = encoder
+	}
+	s.onDecoded = func(c *Client, msg any) {
+		fn(c, msg.(T))
+	}
+}
+
+type typedDecoder[T any] struct {
+	codec Codec[T]
+}
+
+func (d typedDecoder[T]) Decode(data []byte) (any, error) {
+	msg, err := d.codec.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if v, ok := any(msg).(Validator); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// Typed adapts a codec that decodes into any, such as ProtobufCodec with New
+// set, to one that decodes into T. A value of another type is a decode
+// error.
+func Typed[T any](codec Codec[any]) Codec[T] {
+	return typedCodec[T]{Codec: codec}
+}
+
+type typedCodec[T any] struct {
+	Codec[any]
+}
+
+func (c typedCodec[T]) Decode(data []byte) (T, error) {
+	var zero T
+	v, err := c.Codec.Decode(data)
+	if err != nil {
+		return zero, err
+	}
+	msg, ok := v.(T)
+	if !ok {
+		return zero, fmt.Errorf("brts: decoded %T, want %T", v, zero)
+	}
+	return msg, nil
+}
+
+// EncodeFrame keeps the underlying codec's framing of outgoing messages.
+func (c typedCodec[T]) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return encodeFrame(c.Codec, dst, payload)
+}
+
+// Encode keeps the underlying codec's encoder, if it has one.
+func (c typedCodec[T]) Encode(v any) ([]byte, error) {
+	encoder, ok := c.Codec.(Encoder)
+	if !ok {
+		return nil, errors.New("brts: codec can not encode")
+	}
+	return encoder.Encode(v)
+}
+
+// Encoder turns a value into a message for Client.WriteValue.
+type Encoder interface {
+	Encode(v any) ([]byte, error)
+}
+
+// WriteValue encodes v with the server's encoder and writes it.
+func (c *Client) WriteValue(v any) error {
+	if c.encoder == nil {
+		return errors.New("brts: no encoder configured")
+	}
+	data, err := c.encoder.Encode(v)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(data)
+	return err
+}
+
+// VarintFramer reads messages preceded by their length as an unsigned
+// varint, the streaming convention of protobuf. Longer frames than
+// MaxLength are rejected with ErrFrameTooLarge; zero means
+// DefaultMaxFrameLength and a negative MaxLength removes the limit.
+type VarintFramer struct {
+	MaxLength int
+}
+
+func (f VarintFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f VarintFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+
+	var length uint64
+	for i := 0; ; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			if i > 0 {
+				err = unexpectedEOF(err)
+			}
+			return dst, err
+		}
+		if i == binary.MaxVarintLen64-1 && b > 1 {
+			return dst, ErrVarintOverflow
+		}
+		length |= uint64(b&0x7f) << (7 * i)
+		if b < 0x80 {
+			break
+		}
+	}
+	if max := f.maxLength(); length > math.MaxInt || max >= 0 && length > uint64(max) {
+		return dst, ErrFrameTooLarge
+	}
+	return readFull(dst, r, int(length))
+}
+
+// maxLength returns the frame size limit, or -1 for none.
+func (f VarintFramer) maxLength() int {
+	switch {
+	case f.MaxLength == 0:
+		return DefaultMaxFrameLength
+	case f.MaxLength < 0:
+		return -1
+	}
+	return f.MaxLength
+}
+
+func (f VarintFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	if max := f.maxLength(); max >= 0 && len(payload) > max {
+		return dst, ErrFrameTooLarge
+	}
+	dst = binary.AppendUvarint(dst, uint64(len(payload)))
+	return append(dst, payload...), nil
+}
+
+// ProtobufCodec reads length-delimited protobuf messages. With New and
+// Unmarshal set, each message is unmarshalled into a fresh value of the
+// registered type, for example:
+//
+//	brts.ProtobufCodec{
+//		New:       func() any { return new(pb.Reading) },
+//		Unmarshal: func(b []byte, m any) error { return proto.Unmarshal(b, m.(proto.Message)) },
+//	}
+//
+// Without them Decode returns the message bytes.
+type ProtobufCodec struct {
+	MaxLength int
+	New       func() any
+	Unmarshal func(data []byte, m any) error
+}
+
+func (c ProtobufCodec) ReadFrame(r io.Reader) ([]byte, error) {
+	return c.AppendFrame(nil, r)
+}
+
+func (c ProtobufCodec) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	return VarintFramer{MaxLength: c.MaxLength}.AppendFrame(dst, r)
+}
+
+func (c ProtobufCodec) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return VarintFramer{MaxLength: c.MaxLength}.EncodeFrame(dst, payload)
+}
+
+func (c ProtobufCodec) Decode(data []byte) (any, error) {
+	if c.New == nil || c.Unmarshal == nil {
+		return data, nil
+	}
+	m := c.New()
+	if err := c.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// JSONLinesCodec reads one JSON object per line, skipping blank lines.
+// Decode returns a map[string]any, or a value of the registered type when
+// New is set:
+//
+//	brts.JSONLinesCodec{New: func() any { return new(Reading) }}
+//
+// A non-zero MaxLength rejects longer lines with ErrFrameTooLarge.
+type JSONLinesCodec struct {
+	MaxLength int
+	New       func() any
+}
+
+func (c JSONLinesCodec) ReadFrame(r io.Reader) ([]byte, error) {
+	return c.AppendFrame(nil, r)
+}
+
+func (c JSONLinesCodec) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	start := len(dst)
+	for {
+		line, err := SequenceFramer{Delim: []byte{'\n'}, Strip: true, MaxLength: c.MaxLength}.AppendFrame(dst, r)
+		if err != nil {
+			return line[:start], err
+		}
+		if trimmed := bytes.TrimRight(line[start:], "\r"); len(bytes.TrimSpace(trimmed)) > 0 {
+			return line[:start+len(trimmed)], nil
+		}
+		dst = line[:start]
+	}
+}
+
+func (c JSONLinesCodec) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return SequenceFramer{Delim: []byte{'\n'}}.EncodeFrame(dst, payload)
+}
+
+func (c JSONLinesCodec) Decode(data []byte) (any, error) {
+	if c.New == nil {
+		var m map[string]any
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+	v := c.New()
+	if err := json.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// decode runs the decoder and hands the value to OnDecoded, or the message
+// to OnDecodeError when it can not be decoded.
+func (s *Server) decode(c *Client, data []byte) {
+	msg, err := s.decoder.Decode(data)
+	if err != nil {
+		s.onDecodeError(c, data, err)
+		return
+	}
+	s.onDecoded(c, msg)
+}
+
+// OnDecoded receives the messages decoded by the server's decoder in place
+// of OnMessageReceive.
+func (s *Server) OnDecoded(callback func(c *Client, msg any)) {
+	s.onDecoded = callback
+}
+
+func (s *Server) OnDecodeError(callback func(c *Client, data []byte, err error)) {
+	s.onDecodeError = callback
+}
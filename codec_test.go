@@ -0,0 +1,24 @@
+package brts
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestVarintFramerLimit(t *testing.T) {
+	huge := string(binary.AppendUvarint(nil, 1<<63))
+	if _, err := (VarintFramer{MaxLength: -1}).ReadFrame(strings.NewReader(huge)); err != ErrFrameTooLarge {
+		t.Fatalf("length past math.MaxInt: %v, want ErrFrameTooLarge", err)
+	}
+
+	large := string(binary.AppendUvarint(nil, DefaultMaxFrameLength+1))
+	if _, err := (VarintFramer{}).ReadFrame(strings.NewReader(large)); err != ErrFrameTooLarge {
+		t.Fatalf("default limit: %v, want ErrFrameTooLarge", err)
+	}
+
+	frame, err := (VarintFramer{}).ReadFrame(strings.NewReader("\x03abcd"))
+	if err != nil || string(frame) != "abc" {
+		t.Fatalf("frame %q, %v", frame, err)
+	}
+}
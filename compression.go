@@ -0,0 +1,267 @@
+package brts
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrCompressionUnsupported = errors.New("brts: compression not supported")
+
+// Compression is a stream compression algorithm. Writers are flushed after
+// every write, so each message reaches the peer without waiting for more.
+type Compression interface {
+	NewReader(r io.Reader) (io.Reader, error)
+	NewWriter(w io.Writer) (FlushWriter, error)
+}
+
+type FlushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+var compressions sync.Map
+
+func init() {
+	RegisterCompression("gzip", gzipCompression{})
+	RegisterCompression("deflate", deflateCompression{})
+}
+
+// RegisterCompression makes an algorithm available under name, replacing any
+// registered before. gzip and deflate are built in; others such as snappy or
+// zstd can be registered from their packages.
+func RegisterCompression(name string, c Compression) {
+	compressions.Store(name, c)
+}
+
+func lookupCompression(name string) (Compression, bool) {
+	c, ok := compressions.Load(name)
+	if !ok {
+		return nil, false
+	}
+	return c.(Compression), true
+}
+
+type gzipCompression struct{}
+
+func (gzipCompression) NewReader(r io.Reader) (io.Reader, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCompression) NewWriter(w io.Writer) (FlushWriter, error) {
+	return gzip.NewWriter(w), nil
+}
+
+type deflateCompression struct{}
+
+func (deflateCompression) NewReader(r io.Reader) (io.Reader, error) {
+	return flate.NewReader(r), nil
+}
+
+func (deflateCompression) NewWriter(w io.Writer) (FlushWriter, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+// CompressionStats counts the bytes of a compressed connection before and
+// after compression, in both directions.
+type CompressionStats struct {
+	Algorithm string
+	BytesIn   int64
+	WireIn    int64
+	BytesOut  int64
+	WireOut   int64
+}
+
+// Ratio is the uncompressed size of all traffic divided by its size on the
+// wire, or zero before any traffic.
+func (s CompressionStats) Ratio() float64 {
+	wire := s.WireIn + s.WireOut
+	if wire == 0 {
+		return 0
+	}
+	return float64(s.BytesIn+s.BytesOut) / float64(wire)
+}
+
+// compressedConn compresses what is written to the connection and
+// decompresses what is read from it.
+type compressedConn struct {
+	net.Conn
+	name        string
+	compression Compression
+
+	source io.Reader
+	reader io.Reader
+	err    error
+
+	mu     *sync.Mutex
+	writer FlushWriter
+
+	bytesIn  atomic.Int64
+	wireIn   atomic.Int64
+	bytesOut atomic.Int64
+	wireOut  atomic.Int64
+}
+
+// Read creates the decompressor on first use, as some formats start with a
+// header that the peer only sends once it compresses.
+func (cc *compressedConn) Read(p []byte) (int, error) {
+	if cc.reader == nil && cc.err == nil {
+		source := cc.source
+		if source == nil {
+			source = cc.Conn
+		}
+		cc.reader, cc.err = cc.compression.NewReader(countingReader{r: source, n: &cc.wireIn})
+	}
+	if cc.err != nil {
+		return 0, cc.err
+	}
+	n, err := cc.reader.Read(p)
+	cc.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (cc *compressedConn) Write(p []byte) (int, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	n, err := cc.writer.Write(p)
+	if err == nil {
+		err = cc.writer.Flush()
+	}
+	cc.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (cc *compressedConn) stats() CompressionStats {
+	return CompressionStats{
+		Algorithm: cc.name,
+		BytesIn:   cc.bytesIn.Load(),
+		WireIn:    cc.wireIn.Load(),
+		BytesOut:  cc.bytesOut.Load(),
+		WireOut:   cc.wireOut.Load(),
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (cr countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(int64(n))
+	return n, err
+}
+
+// EnableCompression compresses the connection with the named algorithm from
+// now on. Like UpgradeTLS it is meant to be called from a message callback
+// once both sides agreed, and the peer must not send compressed data before
+// that. Writes are compressed at once; reads from the end of the message
+// being handled, including any bytes already buffered after it. It is not
+// available on datagram connections or with an event engine.
+func (c *Client) EnableCompression(name string) error {
+	compression, ok := lookupCompression(name)
+	if !ok {
+		return ErrCompressionUnsupported
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.Conn.(type) {
+	case *compressedConn, *udpConn:
+		return ErrCompressionUnsupported
+	}
+	if c.detach != nil {
+		return ErrCompressionUnsupported
+	}
+
+	cc := &compressedConn{
+		Conn:        c.Conn,
+		name:        name,
+		compression: compression,
+		mu:          &sync.Mutex{},
+	}
+	writer, err := compression.NewWriter(countingWriter{w: c.Conn, n: &cc.wireOut})
+	if err != nil {
+		return err
+	}
+	cc.writer = writer
+	c.Conn = cc
+	c.compressing = cc
+	return nil
+}
+
+// startCompression switches the read loop to a compression enabled since
+// the last frame. The bytes br buffered past the frame boundary came from
+// the peer after it switched, so they are handed to the decompressor
+// ahead of the connection.
+func (c *Client) startCompression(br *bufio.Reader) {
+	c.mu.Lock()
+	cc := c.compressing
+	c.compressing = nil
+	c.mu.Unlock()
+	if cc == nil {
+		return
+	}
+
+	if n := br.Buffered(); n > 0 {
+		pending, _ := br.Peek(n)
+		cc.source = io.MultiReader(bytes.NewReader(bytes.Clone(pending)), cc.Conn)
+		br.Discard(n)
+	}
+}
+
+// NegotiateCompression enables the first of the server's compressions, in
+// the order given to WithCompression, that the peer offered, and returns its
+// name.
+func (c *Client) NegotiateCompression(offered ...string) (string, error) {
+	for _, name := range c.compressions {
+		if containsString(offered, name) {
+			return name, c.EnableCompression(name)
+		}
+	}
+	return "", ErrCompressionUnsupported
+}
+
+// CompressionStats reports the traffic of a compressed connection; ok is
+// false when compression is not enabled.
+func (c *Client) CompressionStats() (stats CompressionStats, ok bool) {
+	c.mu.Lock()
+	cc, ok := c.Conn.(*compressedConn)
+	c.mu.Unlock()
+	if !ok {
+		return stats, false
+	}
+	return cc.stats(), true
+}
+
+// plainConn returns the connection under any compression and under the
+// replay of sniffed bytes, such as the TLS connection.
+func plainConn(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *compressedConn:
+			conn = c.Conn
+		case *sniffConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
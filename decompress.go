@@ -0,0 +1,103 @@
+package brts
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+var ErrDecompressionLimit = errors.New("brts: decompressed stream exceeds ratio limit")
+
+// minInflateCheck is how much a stream may decompress to before its ratio is
+// checked, so short, highly compressible streams are not rejected.
+const minInflateCheck = 64 << 10
+
+func init() {
+	RegisterCompression("zlib", zlibCompression{})
+}
+
+type zlibCompression struct{}
+
+func (zlibCompression) NewReader(r io.Reader) (io.Reader, error) {
+	return zlib.NewReader(r)
+}
+
+func (zlibCompression) NewWriter(w io.Writer) (FlushWriter, error) {
+	return zlib.NewWriter(w), nil
+}
+
+// inflateFormats are the compressed formats recognised by the start of a
+// stream.
+var inflateFormats = []struct {
+	name  string
+	magic func(b []byte) bool
+}{
+	{"gzip", func(b []byte) bool { return b[0] == 0x1f && b[1] == 0x8b }},
+	{"zlib", zlibHeader},
+}
+
+// zlibHeader reports whether b starts with a zlib header: deflate with a
+// window of at most 32 KiB, no preset dictionary and a valid check value.
+func zlibHeader(b []byte) bool {
+	cmf, flg := b[0], b[1]
+	return cmf&0x0f == 8 && cmf>>4 <= 7 && flg&0x20 == 0 && (uint16(cmf)<<8|uint16(flg))%31 == 0
+}
+
+// decompress detects a compressed inbound stream by its first bytes and
+// returns a reader of the decompressed bytes for the framer, or nil when the
+// stream is not compressed with one of the enabled formats.
+func (s *Server) decompress(c *Client, br *bufio.Reader) *bufio.Reader {
+	if len(s.inflate) == 0 {
+		return nil
+	}
+	// Wait for the first byte only; a client that sent a single byte is
+	// not held up waiting for a second.
+	if _, err := br.Peek(1); err != nil {
+		return nil
+	}
+	head, _ := br.Peek(br.Buffered())
+	if len(head) < 2 {
+		return nil
+	}
+
+	for _, format := range inflateFormats {
+		if !containsString(s.inflate, format.name) || !format.magic(head) {
+			continue
+		}
+		compression, ok := lookupCompression(format.name)
+		if !ok {
+			return nil
+		}
+
+		lr := &inflateReader{maxRatio: int64(s.inflateRatio)}
+		r, err := compression.NewReader(countingReader{r: br, n: &lr.wire})
+		if err != nil {
+			s.logger.Printf("Error %s: %v", c.Conn.RemoteAddr(), err)
+			s.onError(c, &FramingError{Err: err})
+			return nil
+		}
+		lr.r = r
+		return getReader(lr, s.readBufSize)
+	}
+	return nil
+}
+
+// inflateReader fails once the decompressed stream grows beyond maxRatio
+// times the compressed bytes read, which stops decompression bombs.
+type inflateReader struct {
+	r        io.Reader
+	wire     atomic.Int64
+	out      int64
+	maxRatio int64
+}
+
+func (lr *inflateReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.out += int64(n)
+	if lr.maxRatio > 0 && lr.out > minInflateCheck && lr.out > lr.maxRatio*lr.wire.Load() {
+		return n, ErrDecompressionLimit
+	}
+	return n, err
+}
@@ -0,0 +1,107 @@
+package brts
+
+// ReplacedReason is the CloseReason of clients disconnected because their
+// device was bound to a new connection.
+const ReplacedReason = "device reconnected"
+
+// BindDevice registers the client as the connection of a device, by an
+// application level ID such as an IMEI, serial number or token, so
+// ClientByDeviceID and SendTo find it. Messages stored in the outbox while
+// the device was offline are sent first. When the device was still bound to
+// another client, OnDuplicateDevice is called and that client disconnected.
+// The binding ends when the client disconnects.
+func (s *Server) BindDevice(c *Client, device string) error {
+	if s.outbox == nil {
+		old, err := s.bindDevice(c, device)
+		if err == nil {
+			s.replaced(device, old, c)
+		}
+		return err
+	}
+
+	// Stored messages are sent without holding the outbox, so SendTo is
+	// not held up by the client. Messages stored meanwhile are sent in the
+	// next round, and the device is bound once none are left.
+	for {
+		s.outbox.mu.Lock()
+		msgs, err := s.outbox.store.Load(device)
+		if err != nil || len(msgs) == 0 {
+			var old *Client
+			if err == nil {
+				old, err = s.bindDevice(c, device)
+			}
+			s.outbox.mu.Unlock()
+			if err == nil {
+				s.replaced(device, old, c)
+			}
+			return err
+		}
+		s.outbox.sending[device] = true
+		s.outbox.mu.Unlock()
+
+		sent, err := s.outbox.send(c, msgs)
+
+		s.outbox.mu.Lock()
+		delete(s.outbox.sending, device)
+		rerr := s.outbox.remove(device, sent)
+		s.outbox.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// bindDevice binds the device to c and returns the client it was bound to
+// before, if any.
+func (s *Server) bindDevice(c *Client, device string) (*Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[c.id] != c {
+		return nil, ErrClientGone
+	}
+	if c.device != "" && s.devices[c.device] == c {
+		delete(s.devices, c.device)
+	}
+	old := s.devices[device]
+	c.mu.Lock()
+	c.device = device
+	c.mu.Unlock()
+	s.devices[device] = c
+	return old, nil
+}
+
+// replaced disconnects the client a device was bound to before c.
+func (s *Server) replaced(device string, old, c *Client) {
+	if old == nil || old == c {
+		return
+	}
+	s.onDuplicate(device, old, c)
+	old.mu.Lock()
+	old.reason = ReplacedReason
+	old.mu.Unlock()
+	old.Close()
+}
+
+// ClientByDeviceID returns the client bound to the device, or nil when the
+// device is offline.
+func (s *Server) ClientByDeviceID(device string) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.devices[device]
+}
+
+// DeviceID reports the device the client was bound to with BindDevice.
+func (c *Client) DeviceID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.device
+}
+
+// OnDuplicateDevice is called when a device that is still connected is
+// bound to a new client, before the old client is disconnected.
+func (s *Server) OnDuplicateDevice(callback func(device string, old, replacement *Client)) {
+	s.onDuplicate = callback
+}
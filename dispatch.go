@@ -0,0 +1,171 @@
+package brts
+
+import (
+	"sync"
+)
+
+// maxTasksPerTurn is how many callbacks a worker runs for one client before
+// giving other ready clients a turn.
+const maxTasksPerTurn = 16
+
+// workerPool runs message callbacks on a fixed number of goroutines. Every
+// client has its own serial queue: at most one worker runs a client's
+// callbacks at a time, in arrival order, while different clients are served
+// in parallel.
+type workerPool struct {
+	mu        *sync.Mutex
+	cond      *sync.Cond
+	ready     []*Client
+	stopped   bool
+	highWater int
+	lowWater  int
+	wg        *sync.WaitGroup
+}
+
+func newWorkerPool(workers, highWater, lowWater int) *workerPool {
+	p := &workerPool{
+		mu:        &sync.Mutex{},
+		highWater: max(highWater, 1),
+		lowWater:  min(max(lowWater, 0), max(highWater, 1)-1),
+		wg:        &sync.WaitGroup{},
+	}
+	p.cond = sync.NewCond(p.mu)
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for {
+		p.mu.Lock()
+		for len(p.ready) == 0 && !p.stopped {
+			p.cond.Wait()
+		}
+		if len(p.ready) == 0 {
+			p.mu.Unlock()
+			return
+		}
+		c := p.ready[0]
+		p.ready = p.ready[1:]
+		p.mu.Unlock()
+
+		if c.runTasks() {
+			p.schedule(c)
+		}
+	}
+}
+
+func (p *workerPool) schedule(c *Client) {
+	p.mu.Lock()
+	p.ready = append(p.ready, c)
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// stop lets the workers exit once every ready client has been served. No
+// client may dispatch after it is called.
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	p.stopped = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+func (s *Server) stopWorkers() {
+	s.mu.Lock()
+	pool := s.pool
+	s.pool = nil
+	s.mu.Unlock()
+
+	if pool != nil {
+		pool.stop()
+	}
+}
+
+func (c *Client) attach(pool *workerPool) {
+	c.pool = pool
+	c.drained = sync.NewCond(c.mu)
+}
+
+// dispatch queues fn behind the client's earlier callbacks, or runs it
+// inline when the server has no worker pool. Once the high-water mark of
+// queued callbacks is reached it blocks, which stops reading from the
+// connection, until the queue is back down to the low-water mark.
+func (c *Client) dispatch(fn func()) {
+	if c.pool == nil {
+		fn()
+		return
+	}
+
+	c.pending.Add(1)
+	c.mu.Lock()
+	c.tasks = append(c.tasks, fn)
+	schedule := !c.scheduled
+	c.scheduled = true
+	c.mu.Unlock()
+
+	if schedule {
+		c.pool.schedule(c)
+	}
+
+	c.mu.Lock()
+	if len(c.tasks) >= c.pool.highWater {
+		c.paused = true
+		if c.resume != nil {
+			// An event loop cannot block; it stops polling the connection
+			// instead and is resumed from runTasks.
+			c.mu.Unlock()
+			return
+		}
+		for len(c.tasks) > c.pool.lowWater {
+			c.drained.Wait()
+		}
+		c.paused = false
+	}
+	c.mu.Unlock()
+}
+
+// runTasks runs a turn of the client's queued callbacks and reports whether
+// more are waiting, in which case the client must be scheduled again.
+func (c *Client) runTasks() bool {
+	for i := 0; i < maxTasksPerTurn; i++ {
+		c.mu.Lock()
+		if len(c.tasks) == 0 {
+			c.scheduled = false
+			c.mu.Unlock()
+			return false
+		}
+		fn := c.tasks[0]
+		c.tasks[0] = nil
+		c.tasks = c.tasks[1:]
+		var resume func()
+		if c.paused && len(c.tasks) <= c.pool.lowWater {
+			if c.resume != nil {
+				c.paused = false
+				resume = c.resume
+			} else {
+				c.drained.Broadcast()
+			}
+		}
+		c.mu.Unlock()
+
+		if resume != nil {
+			resume()
+		}
+
+		fn()
+		c.pending.Done()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.tasks) == 0 {
+		c.scheduled = false
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package brts
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Engine selects how connections are read.
+type Engine int
+
+const (
+	// EngineGoroutine reads every connection on its own goroutine.
+	EngineGoroutine Engine = iota
+	// EngineEpoll multiplexes plain TCP and unix connections on a few epoll
+	// event loops, for servers holding very many mostly idle connections.
+	// Callbacks run on the worker pool. TLS, PROXY protocol and UDP
+	// connections keep a goroutine each. Linux only.
+	EngineEpoll
+	// EngineIOUring is like EngineEpoll but receives through io_uring.
+	// Experimental: Linux only, and only when built with the brts_iouring
+	// tag.
+	EngineIOUring
+)
+
+var ErrEngineUnsupported = errors.New("brts: engine not supported on this platform")
+
+const (
+	defaultEngineQueue = 64
+	engineReadSize     = 16 * 1024
+)
+
+func (s *Server) eventEngine() *eventEngine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.events
+}
+
+func (s *Server) stopEngine() {
+	s.mu.Lock()
+	events := s.events
+	s.events = nil
+	s.mu.Unlock()
+
+	if events != nil {
+		events.stop()
+	}
+}
+
+// bufferReader lets the framers parse bytes an event loop has already
+// received. Running out of data ends a read with io.EOF, which tells the
+// loop the frame is incomplete; pos is how much a complete frame used.
+type bufferReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bufferReader) Read(p []byte) (int, error) {
+	if r.pos >= len(r.buf) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.buf[r.pos:])
+	r.pos += n
+	return n, nil
+}
+
+func (r *bufferReader) ReadByte() (byte, error) {
+	if r.pos >= len(r.buf) {
+		return 0, io.EOF
+	}
+	b := r.buf[r.pos]
+	r.pos++
+	return b, nil
+}
+
+// Peek reports a short buffer as io.ErrUnexpectedEOF rather than io.EOF, as
+// more data may still arrive.
+func (r *bufferReader) Peek(n int) ([]byte, error) {
+	rest := r.buf[r.pos:]
+	if len(rest) < n {
+		return rest, io.ErrUnexpectedEOF
+	}
+	return rest[:n], nil
+}
+
+func (r *bufferReader) Discard(n int) (int, error) {
+	n = min(n, len(r.buf)-r.pos)
+	r.pos += n
+	return n, nil
+}
+
+func (r *bufferReader) Buffered() int {
+	return len(r.buf) - r.pos
+}
+
+func (r *bufferReader) ReadSlice(delim byte) ([]byte, error) {
+	rest := r.buf[r.pos:]
+	if i := bytes.IndexByte(rest, delim); i >= 0 {
+		r.pos += i + 1
+		return rest[:i+1], nil
+	}
+	r.pos = len(r.buf)
+	return rest, io.EOF
+}
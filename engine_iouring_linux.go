@@ -0,0 +1,329 @@
+//go:build linux && brts_iouring
+
+package brts
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const ioUringBuilt = true
+
+const (
+	uringEntries  = 4096
+	uringRecvSize = 4096
+
+	uringOpTimeout     = 11
+	uringOpAsyncCancel = 14
+	uringOpRead        = 22
+	uringOpRecv        = 27
+
+	uringEnterGetEvents = 1
+	uringFeatSingleMmap = 1
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	// User data of the operations that are not connection receives.
+	uringWakeID    = 0
+	uringTimeoutID = math.MaxUint64
+	uringCancelID  = math.MaxUint64 - 1
+)
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  uringSQOffsets
+	cqOff                                                                  uringCQOffsets
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFD    int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// uringPoller receives data through io_uring: every connection has one
+// receive outstanding, completions are handled by the loop. Writes still go
+// through the connection. Experimental.
+type uringPoller struct {
+	fd      int
+	sqRing  []byte
+	cqRing  []byte
+	sqes    []byte
+	sqHead  *uint32
+	sqTail  *uint32
+	sqMask  uint32
+	sqArray []uint32
+	cqHead  *uint32
+	cqTail  *uint32
+	cqMask  uint32
+	cqes    []uringCQE
+
+	// mu serialises submissions, which come from the loop and from workers
+	// resuming connections. pinned keeps the buffers of outstanding
+	// receives alive until they complete, even after their connection is
+	// gone.
+	mu      *sync.Mutex
+	pinned  map[uint64][]byte
+	wakefd  int
+	wakeBuf [8]byte
+	timeout unix.Timespec
+}
+
+func newURingPoller() (poller, error) {
+	var params uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uringEntries, uintptr(unsafe.Pointer(&params)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	p := &uringPoller{
+		fd:     int(fd),
+		mu:     &sync.Mutex{},
+		pinned: make(map[uint64][]byte),
+	}
+	if err := p.mmap(&params); err != nil {
+		p.close()
+		return nil, err
+	}
+
+	wakefd, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.wakefd = wakefd
+	p.timeout = unix.NsecToTimespec(int64(engineSweepInterval))
+
+	p.mu.Lock()
+	p.prepare(uringOpRead, p.wakefd, uintptr(unsafe.Pointer(&p.wakeBuf[0])), uint32(len(p.wakeBuf)), 0, uringWakeID)
+	p.prepare(uringOpTimeout, -1, uintptr(unsafe.Pointer(&p.timeout)), 1, 0, uringTimeoutID)
+	err = p.submit()
+	p.mu.Unlock()
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *uringPoller) mmap(params *uringParams) error {
+	sqSize := int(params.sqOff.array + params.sqEntries*4)
+	cqSize := int(params.cqOff.cqes + params.cqEntries*uint32(unsafe.Sizeof(uringCQE{})))
+	if params.features&uringFeatSingleMmap != 0 {
+		sqSize = max(sqSize, cqSize)
+	}
+
+	var err error
+	p.sqRing, err = unix.Mmap(p.fd, uringOffSQRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+	p.cqRing = p.sqRing
+	if params.features&uringFeatSingleMmap == 0 {
+		p.cqRing, err = unix.Mmap(p.fd, uringOffCQRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+		if err != nil {
+			return err
+		}
+	}
+	p.sqes, err = unix.Mmap(p.fd, uringOffSQEs, int(params.sqEntries)*int(unsafe.Sizeof(uringSQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return err
+	}
+
+	p.sqHead = (*uint32)(unsafe.Pointer(&p.sqRing[params.sqOff.head]))
+	p.sqTail = (*uint32)(unsafe.Pointer(&p.sqRing[params.sqOff.tail]))
+	p.sqMask = *(*uint32)(unsafe.Pointer(&p.sqRing[params.sqOff.ringMask]))
+	p.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&p.sqRing[params.sqOff.array])), params.sqEntries)
+	p.cqHead = (*uint32)(unsafe.Pointer(&p.cqRing[params.cqOff.head]))
+	p.cqTail = (*uint32)(unsafe.Pointer(&p.cqRing[params.cqOff.tail]))
+	p.cqMask = *(*uint32)(unsafe.Pointer(&p.cqRing[params.cqOff.ringMask]))
+	p.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&p.cqRing[params.cqOff.cqes])), params.cqEntries)
+	return nil
+}
+
+// prepare fills the next submission queue entry. The caller holds p.mu and
+// calls submit afterwards.
+func (p *uringPoller) prepare(op uint8, fd int, addr uintptr, length uint32, off uint64, userData uint64) {
+	tail := atomic.LoadUint32(p.sqTail)
+	index := tail & p.sqMask
+	sqe := (*uringSQE)(unsafe.Pointer(&p.sqes[uintptr(index)*unsafe.Sizeof(uringSQE{})]))
+	*sqe = uringSQE{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      off,
+		addr:     uint64(addr),
+		len:      length,
+		userData: userData,
+	}
+	p.sqArray[index] = index
+	atomic.StoreUint32(p.sqTail, tail+1)
+}
+
+func (p *uringPoller) submit() error {
+	pending := atomic.LoadUint32(p.sqTail) - atomic.LoadUint32(p.sqHead)
+	for pending > 0 {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(p.fd), uintptr(pending), 0, 0, 0, 0)
+		if errno == unix.EINTR || errno == unix.EAGAIN || errno == unix.EBUSY {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		pending -= uint32(n)
+	}
+	return nil
+}
+
+// arm submits a receive unless one is still outstanding; its completion
+// arms the next. The caller holds ec.mu.
+func (p *uringPoller) arm(ec *eventConn) error {
+	if ec.inflight {
+		return nil
+	}
+	if ec.recv == nil {
+		ec.recv = make([]byte, uringRecvSize)
+	}
+
+	var fd int
+	if err := ec.raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prepare(uringOpRecv, fd, uintptr(unsafe.Pointer(&ec.recv[0])), uint32(len(ec.recv)), 0, ec.id)
+	if err := p.submit(); err != nil {
+		return err
+	}
+	p.pinned[ec.id] = ec.recv
+	ec.inflight = true
+	return nil
+}
+
+// disarm cancels the outstanding receive. The caller holds ec.mu.
+func (p *uringPoller) disarm(ec *eventConn) {
+	if !ec.inflight {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.prepare(uringOpAsyncCancel, -1, uintptr(ec.id), 0, 0, uringCancelID)
+	p.submit()
+}
+
+func (p *uringPoller) poll(l *eventLoop, timeout time.Duration) (bool, error) {
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(p.fd), 0, 1, uringEnterGetEvents, 0, 0)
+	if errno != 0 && errno != unix.EINTR {
+		return false, errno
+	}
+
+	running := true
+	head := atomic.LoadUint32(p.cqHead)
+	tail := atomic.LoadUint32(p.cqTail)
+	for ; head != tail; head++ {
+		cqe := p.cqes[head&p.cqMask]
+		switch cqe.userData {
+		case uringWakeID:
+			running = false
+		case uringTimeoutID:
+			p.mu.Lock()
+			p.prepare(uringOpTimeout, -1, uintptr(unsafe.Pointer(&p.timeout)), 1, 0, uringTimeoutID)
+			p.submit()
+			p.mu.Unlock()
+		case uringCancelID:
+		default:
+			p.mu.Lock()
+			delete(p.pinned, cqe.userData)
+			p.mu.Unlock()
+
+			if ec := l.lookup(cqe.userData); ec != nil {
+				p.completed(ec, cqe.res)
+			}
+		}
+	}
+	atomic.StoreUint32(p.cqHead, head)
+	return running, nil
+}
+
+func (p *uringPoller) completed(ec *eventConn, res int32) {
+	ec.mu.Lock()
+	ec.inflight = false
+	ec.mu.Unlock()
+
+	switch {
+	case res == -int32(syscall.ECANCELED):
+	case res < 0:
+		ec.received(0, syscall.Errno(-res))
+		return
+	default:
+		ec.buf = append(ec.buf, ec.recv[:res]...)
+		ec.received(int(res), nil)
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if !ec.suspended && !ec.closed {
+		if err := p.arm(ec); err != nil {
+			go ec.close(err)
+		}
+	}
+}
+
+func (p *uringPoller) wake() {
+	var one [8]byte
+	one[0] = 1
+	unix.Write(p.wakefd, one[:])
+}
+
+func (p *uringPoller) close() {
+	if p.sqes != nil {
+		unix.Munmap(p.sqes)
+	}
+	if p.cqRing != nil && &p.cqRing[0] != &p.sqRing[0] {
+		unix.Munmap(p.cqRing)
+	}
+	if p.sqRing != nil {
+		unix.Munmap(p.sqRing)
+	}
+	if p.wakefd > 0 {
+		unix.Close(p.wakefd)
+	}
+	unix.Close(p.fd)
+}
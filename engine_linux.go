@@ -0,0 +1,617 @@
+//go:build linux
+
+package brts
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const engineSweepInterval = time.Second
+
+// States of an OnIdleTimeout call made for an event engine connection.
+const (
+	idleNone = iota
+	idleRunning
+	idleExtended
+	idleExpired
+)
+
+func engineSupported(engine Engine) bool {
+	switch engine {
+	case EngineGoroutine, EngineEpoll:
+		return true
+	case EngineIOUring:
+		return ioUringBuilt
+	}
+	return false
+}
+
+// poller is the readiness or completion mechanism behind an event loop.
+type poller interface {
+	// arm asks for the connection's next data, disarm stops asking.
+	arm(ec *eventConn) error
+	disarm(ec *eventConn)
+	// poll waits up to timeout and handles what happened. It returns false
+	// once the loop has been woken to stop.
+	poll(l *eventLoop, timeout time.Duration) (bool, error)
+	wake()
+	close()
+}
+
+// eventEngine spreads connections over a fixed set of event loops.
+type eventEngine struct {
+	loops []*eventLoop
+	next  atomic.Uint32
+}
+
+func newEventEngine(s *Server, engine Engine, loops int) (*eventEngine, error) {
+	e := &eventEngine{}
+	for i := 0; i < loops; i++ {
+		var p poller
+		var err error
+		if engine == EngineIOUring {
+			p, err = newURingPoller()
+		} else {
+			p, err = newEpollPoller()
+		}
+		if err != nil {
+			e.stop()
+			return nil, err
+		}
+
+		l := newEventLoop(s, p)
+		e.loops = append(e.loops, l)
+		go l.run()
+	}
+	return e, nil
+}
+
+// register hands the client to an event loop. It reports false when the
+// connection cannot be polled, in which case the caller keeps reading it.
+func (e *eventEngine) register(c *Client) bool {
+	switch c.Conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+	default:
+		return false
+	}
+
+	l := e.loops[int(e.next.Add(1))%len(e.loops)]
+	if err := l.add(c); err != nil {
+		l.s.logger.Printf("event loop: %v: %v", c.Conn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+func (e *eventEngine) stop() {
+	for _, l := range e.loops {
+		l.stop()
+	}
+}
+
+// eventLoop reads the connections registered with one poller. Events carry
+// a connection id rather than the descriptor, so a descriptor reused by a
+// newer connection is never mistaken for an older one.
+type eventLoop struct {
+	s      *Server
+	poller poller
+	done   chan struct{}
+
+	mu     *sync.Mutex
+	conns  map[uint64]*eventConn
+	nextID uint64
+}
+
+type eventConn struct {
+	loop   *eventLoop
+	id     uint64
+	c      *Client
+	raw    syscall.RawConn
+	framer Framer
+	batch  *batcher
+	buf    []byte
+	last   atomic.Int64
+	idle   atomic.Int32
+
+	// scanned is how much of the partial frame at the start of buf the
+	// framer's frameScanner has already looked at.
+	scanned int
+
+	// recv and inflight belong to the io_uring poller: the buffer a receive
+	// is submitted with and whether one is outstanding.
+	recv     []byte
+	inflight bool
+
+	mu        *sync.Mutex
+	suspended bool
+	throttled bool
+	closed    bool
+	closeOnce *sync.Once
+}
+
+func newEventLoop(s *Server, p poller) *eventLoop {
+	return &eventLoop{
+		s:      s,
+		poller: p,
+		done:   make(chan struct{}),
+		mu:     &sync.Mutex{},
+		conns:  make(map[uint64]*eventConn),
+	}
+}
+
+func (l *eventLoop) add(c *Client) error {
+	sc, ok := c.Conn.(syscall.Conn)
+	if !ok {
+		return ErrEngineUnsupported
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	ec := &eventConn{
+		loop:      l,
+		c:         c,
+		raw:       raw,
+		framer:    l.s.framerFor(c),
+		batch:     l.s.newBatcher(c),
+		mu:        &sync.Mutex{},
+		closeOnce: &sync.Once{},
+	}
+	ec.last.Store(time.Now().UnixNano())
+
+	l.mu.Lock()
+	l.nextID++
+	ec.id = l.nextID
+	l.conns[ec.id] = ec
+	l.mu.Unlock()
+
+	c.mu.Lock()
+	c.detach = func() { ec.close(nil) }
+	c.resume = ec.resume
+	c.mu.Unlock()
+
+	ec.mu.Lock()
+	err = l.poller.arm(ec)
+	ec.mu.Unlock()
+	if err != nil {
+		l.mu.Lock()
+		delete(l.conns, ec.id)
+		l.mu.Unlock()
+
+		c.mu.Lock()
+		c.detach = nil
+		c.resume = nil
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *eventLoop) lookup(id uint64) *eventConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.conns[id]
+}
+
+func (l *eventLoop) run() {
+	defer close(l.done)
+
+	sweep := time.Now()
+	for {
+		running, err := l.poller.poll(l, engineSweepInterval)
+		if err != nil {
+			l.s.logger.Printf("event loop stopped: %v", err)
+			return
+		}
+		if !running {
+			return
+		}
+
+		if time.Since(sweep) >= engineSweepInterval {
+			l.sweep()
+			sweep = time.Now()
+		}
+	}
+}
+
+// sweep closes connections that have waited for data longer than their idle
+// timeout, unless OnIdleTimeout extends it, or their read timeout when a
+// message is partly received, and those too slow to deliver a message.
+func (l *eventLoop) sweep() {
+	l.mu.Lock()
+	conns := make([]*eventConn, 0, len(l.conns))
+	for _, ec := range l.conns {
+		conns = append(conns, ec)
+	}
+	l.mu.Unlock()
+
+	now := time.Now()
+	for _, ec := range conns {
+		if ec.isSuspended() {
+			continue
+		}
+		ec.c.mu.Lock()
+		receiving := len(ec.buf) > 0
+		timeout := ec.c.waitTimeout(receiving)
+		idle := !(receiving && ec.c.readTimeout > 0)
+		slow := ec.c.checkPace(now)
+		ec.c.mu.Unlock()
+		if slow != nil {
+			ec.close(slow)
+			continue
+		}
+		switch ec.idle.Load() {
+		case idleRunning:
+			continue
+		case idleExtended:
+			ec.last.Store(now.UnixNano())
+			ec.idle.Store(idleNone)
+			continue
+		case idleExpired:
+			// Closed below unless data arrived during the callback.
+			ec.idle.Store(idleNone)
+			idle = false
+		}
+		if timeout > 0 && now.Sub(time.Unix(0, ec.last.Load())) > timeout {
+			if idle {
+				ec.idleTimedOut()
+				continue
+			}
+			l.s.logger.Printf("timeout: %v", ec.c.Conn.RemoteAddr())
+			l.s.onError(ec.c, &TimeoutError{Err: os.ErrDeadlineExceeded})
+			ec.close(nil)
+		}
+	}
+}
+
+// idleTimedOut calls OnIdleTimeout off the event loop, on a worker when
+// the client has a pool, and leaves its outcome for the next sweep.
+func (ec *eventConn) idleTimedOut() {
+	ec.idle.Store(idleRunning)
+	timedOut := func() {
+		if ec.c.idleTimedOut() {
+			ec.idle.Store(idleExtended)
+		} else {
+			ec.idle.Store(idleExpired)
+		}
+	}
+	if ec.c.pool != nil {
+		ec.c.dispatch(timedOut)
+		return
+	}
+	ec.c.pending.Add(1)
+	go func() {
+		defer ec.c.pending.Done()
+		timedOut()
+	}()
+}
+
+func (l *eventLoop) stop() {
+	l.poller.wake()
+	<-l.done
+	l.poller.close()
+}
+
+// received takes n bytes that were appended to the buffer, or the error
+// that ended the connection, and delivers the complete frames.
+func (ec *eventConn) received(n int, err error) {
+	switch {
+	case err != nil:
+		ec.close(err)
+		return
+	case n == 0:
+		ec.close(io.EOF)
+		return
+	}
+	now := time.Now()
+	ec.last.Store(now.UnixNano())
+	ec.c.mu.Lock()
+	ec.c.countRead(n, now)
+	ec.c.mu.Unlock()
+	ec.parse()
+
+	if ec.c.ingress != nil {
+		if wait := ec.c.ingress.reserve(float64(n)); wait > 0 {
+			ec.c.excusePace(wait)
+			ec.throttle(wait)
+		}
+	}
+}
+
+// parse delivers every complete frame in the buffer and keeps the rest for
+// the next read. Framers are rerun from the frame start, so they need no
+// state of their own; a frameScanner keeps that from happening on every read
+// of a long frame.
+func (ec *eventConn) parse() {
+	s := ec.loop.s
+	c := ec.c
+	r := &bufferReader{buf: ec.buf}
+	scanner, _ := ec.framer.(frameScanner)
+
+	for r.pos < len(r.buf) {
+		start := r.pos
+		if scanner != nil {
+			var scanned int
+			if start == 0 {
+				scanned = ec.scanned
+			}
+			if !scanner.frameComplete(r.buf[start:], scanned) {
+				ec.scanned = len(r.buf) - start
+				if s.maxReadSize > 0 && ec.scanned > s.maxReadSize {
+					ec.close(ErrFrameTooLarge)
+					return
+				}
+				break
+			}
+			ec.scanned = 0
+		}
+
+		var m *Message
+		var dst []byte
+		if c.handlers.OnMessage != nil && ec.batch == nil {
+			m = newMessage()
+			dst = m.Data
+		}
+
+		data, err := appendFrame(ec.framer, dst, r, false)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			m.release()
+			r.pos = start
+			if s.maxReadSize > 0 && len(r.buf)-start > s.maxReadSize {
+				ec.close(ErrFrameTooLarge)
+				return
+			}
+			break
+		}
+		if err == nil && s.maxReadSize > 0 && r.pos-start > s.maxReadSize {
+			err = ErrFrameTooLarge
+		}
+		var invalid *InvalidFrameError
+		if errors.As(err, &invalid) {
+			s.invalidFrame(c, invalid)
+			m.release()
+			continue
+		}
+		if err != nil {
+			m.release()
+			ec.close(err)
+			return
+		}
+
+		s.deliver(c, data, m, ec.batch)
+		if r.pos == start {
+			break
+		}
+	}
+
+	rest := copy(ec.buf, r.buf[r.pos:])
+	ec.buf = ec.buf[:rest]
+	if r.pos > 0 {
+		c.startMessage(rest > 0)
+	}
+
+	if c.isPaused() {
+		ec.suspend()
+	}
+}
+
+// suspend stops reading while the client's callbacks are behind, so TCP
+// flow control pushes back on the peer.
+func (ec *eventConn) suspend() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.suspended || ec.closed || !ec.c.isPaused() {
+		return
+	}
+	ec.suspended = true
+	ec.loop.poller.disarm(ec)
+}
+
+// throttle stops reading for wait, to keep within the server's ingress
+// bandwidth.
+func (ec *eventConn) throttle(wait time.Duration) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if ec.closed {
+		return
+	}
+	if !ec.suspended {
+		ec.suspended = true
+		ec.loop.poller.disarm(ec)
+	}
+	ec.throttled = true
+	time.AfterFunc(wait, ec.unthrottle)
+}
+
+func (ec *eventConn) unthrottle() {
+	ec.mu.Lock()
+	ec.throttled = false
+	ec.mu.Unlock()
+
+	// A client whose callbacks are behind is resumed by the worker pool.
+	if !ec.c.isPaused() {
+		ec.resume()
+	}
+}
+
+// resume is called by the worker pool once the client's queue has drained
+// to the low-water mark.
+func (ec *eventConn) resume() {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	if !ec.suspended || ec.throttled || ec.closed {
+		return
+	}
+	ec.suspended = false
+	ec.last.Store(time.Now().UnixNano())
+	if err := ec.loop.poller.arm(ec); err != nil {
+		go ec.close(err)
+	}
+}
+
+func (ec *eventConn) isSuspended() bool {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return ec.suspended
+}
+
+// reading reports whether the poller should keep asking for data.
+func (ec *eventConn) reading() bool {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+	return !ec.suspended && !ec.closed
+}
+
+// close ends the connection and finishes the client in the background.
+// err is reported unless it is nil.
+func (ec *eventConn) close(err error) {
+	ec.closeOnce.Do(func() {
+		l := ec.loop
+		l.mu.Lock()
+		delete(l.conns, ec.id)
+		l.mu.Unlock()
+
+		ec.mu.Lock()
+		if !ec.suspended {
+			l.poller.disarm(ec)
+		}
+		ec.closed = true
+		ec.mu.Unlock()
+
+		if err != nil {
+			l.s.readFailed(ec.c, err)
+		}
+		ec.batch.close()
+		go l.s.finish(ec.c)
+	})
+}
+
+// epollPoller waits for readiness with level-triggered epoll and reads
+// ready connections itself.
+type epollPoller struct {
+	epfd   int
+	wakefd int
+	events []unix.EpollEvent
+}
+
+func newEpollPoller() (*epollPoller, error) {
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	wakefd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, err
+	}
+
+	// The wake descriptor uses id 0, connections start at 1.
+	ev := unix.EpollEvent{Events: unix.EPOLLIN}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakefd, &ev); err != nil {
+		unix.Close(wakefd)
+		unix.Close(epfd)
+		return nil, err
+	}
+
+	return &epollPoller{
+		epfd:   epfd,
+		wakefd: wakefd,
+		events: make([]unix.EpollEvent, 256),
+	}, nil
+}
+
+func eventID(ev *unix.EpollEvent) uint64 {
+	return uint64(uint32(ev.Fd)) | uint64(uint32(ev.Pad))<<32
+}
+
+func setEventID(ev *unix.EpollEvent, id uint64) {
+	ev.Fd = int32(uint32(id))
+	ev.Pad = int32(uint32(id >> 32))
+}
+
+func (p *epollPoller) arm(ec *eventConn) error {
+	return p.control(ec, unix.EPOLL_CTL_ADD)
+}
+
+func (p *epollPoller) disarm(ec *eventConn) {
+	p.control(ec, unix.EPOLL_CTL_DEL)
+}
+
+// control goes through the RawConn so it fails, rather than touching a
+// reused descriptor, once the connection is closed.
+func (p *epollPoller) control(ec *eventConn, op int) error {
+	ev := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP}
+	setEventID(&ev, ec.id)
+
+	var err error
+	if cerr := ec.raw.Control(func(fd uintptr) {
+		err = unix.EpollCtl(p.epfd, op, int(fd), &ev)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *epollPoller) poll(l *eventLoop, timeout time.Duration) (bool, error) {
+	n, err := unix.EpollWait(p.epfd, p.events, int(timeout/time.Millisecond))
+	if err == unix.EINTR {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < n; i++ {
+		id := eventID(&p.events[i])
+		if id == 0 {
+			return false, nil
+		}
+		if ec := l.lookup(id); ec != nil {
+			p.read(ec)
+		}
+	}
+	return true, nil
+}
+
+func (p *epollPoller) read(ec *eventConn) {
+	start := len(ec.buf)
+	ec.buf = slices.Grow(ec.buf, engineReadSize)
+
+	var n int
+	var err error
+	if cerr := ec.raw.Control(func(fd uintptr) {
+		n, err = unix.Read(int(fd), ec.buf[start:start+engineReadSize])
+	}); cerr != nil {
+		ec.received(0, cerr)
+		return
+	}
+	if err == unix.EAGAIN || err == unix.EINTR {
+		return
+	}
+	if n > 0 {
+		ec.buf = ec.buf[:start+n]
+	}
+	ec.received(max(n, 0), err)
+}
+
+func (p *epollPoller) wake() {
+	var one [8]byte
+	one[0] = 1
+	unix.Write(p.wakefd, one[:])
+}
+
+func (p *epollPoller) close() {
+	unix.Close(p.wakefd)
+	unix.Close(p.epfd)
+}
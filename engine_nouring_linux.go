@@ -0,0 +1,9 @@
+//go:build linux && !brts_iouring
+
+package brts
+
+const ioUringBuilt = false
+
+func newURingPoller() (poller, error) {
+	return nil, ErrEngineUnsupported
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package brts
+
+type eventEngine struct{}
+
+func engineSupported(engine Engine) bool {
+	return engine == EngineGoroutine
+}
+
+func newEventEngine(s *Server, engine Engine, loops int) (*eventEngine, error) {
+	return nil, ErrEngineUnsupported
+}
+
+func (e *eventEngine) register(c *Client) bool {
+	return false
+}
+
+func (e *eventEngine) stop() {}
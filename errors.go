@@ -0,0 +1,110 @@
+package brts
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"net"
+)
+
+// FramingError reports received data that could not be read as a message:
+// a frame that is too large or fails validation, or a stream that does not
+// decompress.
+type FramingError struct {
+	Err error
+}
+
+func (e *FramingError) Error() string {
+	return "brts: framing: " + e.Err.Error()
+}
+
+func (e *FramingError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError reports a client disconnected for a timeout: idle, read,
+// handshake or authentication, or a message arriving too slowly.
+type TimeoutError struct {
+	Err error
+}
+
+func (e *TimeoutError) Error() string {
+	return "brts: timeout: " + e.Err.Error()
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// WriteError reports a write to a client that failed, was cancelled or was
+// dropped from a full write queue.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string {
+	return "brts: write: " + e.Err.Error()
+}
+
+func (e *WriteError) Unwrap() error {
+	return e.Err
+}
+
+// AcceptError reports a listener failing to accept connections. Temporary
+// is set when the server retries.
+type AcceptError struct {
+	Addr      net.Addr
+	Temporary bool
+	Err       error
+}
+
+func (e *AcceptError) Error() string {
+	return "brts: accept on " + e.Addr.String() + ": " + e.Err.Error()
+}
+
+func (e *AcceptError) Unwrap() error {
+	return e.Err
+}
+
+// writeFailed reports a failed, cancelled or dropped write.
+func (c *Client) writeFailed(err error) {
+	c.onWriteErr(c, err)
+	c.onErr(c, &WriteError{Err: err})
+}
+
+// framingErrors are what the built-in framers, codecs and decompressors
+// fail with on malformed input.
+var framingErrors = []error{
+	ErrFrameTooLarge, ErrMessageTooLarge, ErrCBOR, ErrMsgpack, ErrVarintOverflow,
+	ErrDecompressionLimit, gzip.ErrHeader, gzip.ErrChecksum, zlib.ErrHeader,
+	zlib.ErrChecksum, zlib.ErrDictionary, bufio.ErrTooLong,
+}
+
+// isFramingError tells errors of the framer from those of the connection
+// it reads from, which include socket and TLS errors.
+func isFramingError(err error) bool {
+	var invalid *InvalidFrameError
+	var corrupt flate.CorruptInputError
+	if errors.As(err, &invalid) || errors.As(err, &corrupt) {
+		return true
+	}
+	for _, target := range framingErrors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnError is called with the errors the server otherwise only logs, each
+// wrapped in one of FramingError, TimeoutError, WriteError and AcceptError
+// so they can be told apart with errors.As. c is nil for an AcceptError.
+func (s *Server) OnError(callback func(c *Client, err error)) {
+	s.onError = callback
+}
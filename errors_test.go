@@ -0,0 +1,97 @@
+package brts
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsFramingError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrFrameTooLarge, true},
+		{fmt.Errorf("reading: %w", ErrMessageTooLarge), true},
+		{&InvalidFrameError{Err: errors.New("bad checksum")}, true},
+		{flate.CorruptInputError(3), true},
+		{gzip.ErrHeader, true},
+		{ErrDecompressionLimit, true},
+		{io.EOF, false},
+		{io.ErrUnexpectedEOF, false},
+		{net.ErrClosed, false},
+		{os.ErrDeadlineExceeded, false},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, false},
+		{errors.New("tls: bad record MAC"), false},
+	}
+	for _, tt := range tests {
+		if got := isFramingError(tt.err); got != tt.want {
+			t.Errorf("isFramingError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// collectErrors registers an OnError callback passing errors on.
+func collectErrors(s *Server) <-chan error {
+	errs := make(chan error, 8)
+	s.OnError(func(c *Client, err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	})
+	return errs
+}
+
+func TestOnErrorFraming(t *testing.T) {
+	s := newServer(t, WithReadBufferSize(0, 16))
+	errs := collectErrors(s)
+	start(t, s)
+
+	conn := dial(t, s)
+	conn.send(t, strings.Repeat("x", 64))
+
+	var framing *FramingError
+	if err := receive(t, errs); !errors.As(err, &framing) || !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("OnError got %v, want a FramingError for ErrFrameTooLarge", err)
+	}
+}
+
+func TestOnErrorTimeout(t *testing.T) {
+	s := newServer(t, WithIdleTimeout(50*time.Millisecond))
+	errs := collectErrors(s)
+	start(t, s)
+
+	dial(t, s)
+
+	var timeout *TimeoutError
+	if err := receive(t, errs); !errors.As(err, &timeout) {
+		t.Fatalf("OnError got %v, want a TimeoutError", err)
+	}
+}
+
+func TestOnErrorWrite(t *testing.T) {
+	s := newServer(t)
+	errs := collectErrors(s)
+	lost := make(chan *Client, 1)
+	s.OnConnectionLost(func(c *Client) { lost <- c })
+	start(t, s)
+
+	dial(t, s).Close()
+	c := receive(t, lost)
+	if err := c.Send([]byte("late")); err == nil {
+		t.Fatal("Send to a disconnected client succeeded")
+	}
+
+	var write *WriteError
+	if err := receive(t, errs); !errors.As(err, &write) {
+		t.Fatalf("OnError got %v, want a WriteError", err)
+	}
+}
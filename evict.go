@@ -0,0 +1,62 @@
+package brts
+
+import (
+	"time"
+)
+
+// EvictedReason is the CloseReason of clients evicted to make room for new
+// connections.
+const EvictedReason = "idle eviction"
+
+// lastActive is when the client last read or wrote data, or connected. The
+// caller must hold c.mu.
+func (c *Client) lastActive() time.Time {
+	active := c.connected
+	if c.lastRead.After(active) {
+		active = c.lastRead
+	}
+	if c.lastWrite.After(active) {
+		active = c.lastWrite
+	}
+	return active
+}
+
+// evictLocked makes room for a new client by evicting the client that has
+// been idle the longest, if it has been idle long enough. Clients still
+// connecting are passed over. The evicted client stays registered until it
+// has shut down but no longer counts against the limit. The caller must
+// hold s.mu.
+func (s *Server) evictLocked() bool {
+	var victim *Client
+	var oldest time.Time
+	for id, c := range s.clients {
+		if _, ok := s.evicting[id]; ok {
+			continue
+		}
+		c.mu.Lock()
+		ready, active := c.ready, c.lastActive()
+		c.mu.Unlock()
+		if ready && (victim == nil || active.Before(oldest)) {
+			victim, oldest = c, active
+		}
+	}
+	if victim == nil || time.Since(oldest) < s.evictAfter {
+		return false
+	}
+
+	s.evicting[victim.id] = struct{}{}
+	go func() {
+		victim.mu.Lock()
+		victim.reason = EvictedReason
+		victim.mu.Unlock()
+		victim.Close()
+		s.onEviction(victim)
+	}()
+	return true
+}
+
+// OnEviction is called with every client evicted to make room for a new
+// connection, see WithIdleEviction.
+func (s *Server) OnEviction(callback func(c *Client)) {
+	s.onEviction = callback
+}
@@ -0,0 +1,48 @@
+package brts
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIdleEviction(t *testing.T) {
+	s := newServer(t, WithMaxClients(1), WithIdleEviction(0))
+	connected := make(chan *Client, 2)
+	s.OnNewConnection(func(c *Client) { connected <- c })
+	evicted := make(chan *Client, 1)
+	s.OnEviction(func(c *Client) { evicted <- c })
+	s.OnMessageReceive(echo)
+	start(t, s)
+
+	first := dial(t, s)
+	idle := receive(t, connected)
+	second := dial(t, s)
+	if c := receive(t, evicted); c != idle {
+		t.Fatalf("evicted client %d, want the idle client %d", c.ID(), idle.ID())
+	}
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := first.r.ReadByte(); err != io.EOF {
+		t.Fatalf("read on the evicted connection: %v, want io.EOF", err)
+	}
+	second.send(t, "hello")
+	second.expect(t, "echo hello")
+}
+
+func TestIdleEvictionSkipsConnecting(t *testing.T) {
+	s := newServer(t, WithMaxClients(1), WithIdleEviction(0))
+	s.OnHandshake(func(c *Client, frame []byte) error { return nil })
+	rejected := make(chan error, 1)
+	s.OnConnectionRejected(func(conn net.Conn, reason error) { rejected <- reason })
+	s.OnEviction(func(c *Client) { t.Errorf("evicted client %d during its handshake", c.ID()) })
+	start(t, s)
+
+	// The first client never sends its handshake frame.
+	dial(t, s)
+	time.Sleep(20 * time.Millisecond)
+	dial(t, s)
+	if err := receive(t, rejected); err != ErrTooManyClients {
+		t.Fatalf("second client rejected with %v, want ErrTooManyClients", err)
+	}
+}
@@ -1,11 +1,12 @@
 package main
 
 import (
-	"brts"
 	"log"
 	"net"
 	"os"
 	"time"
+
+	"github.com/avkspog/brts"
 )
 
 var server *brts.Server
@@ -14,9 +15,11 @@ func main() {
 	host := "127.0.0.1"
 	port := "8002"
 
-	server = brts.Create(host + ":" + port)
-	server.SetTimeout(15 * time.Second)
-	server.SetMessageDelim('\n')
+	server = brts.Create(host+":"+port,
+		brts.WithIdleTimeout(15*time.Second),
+		brts.WithMessageDelim('\n'),
+		brts.WithSignalHandling(true),
+	)
 
 	server.OnServerStarted(func(addr *net.TCPAddr) {
 		log.Printf("BRTS server started on address: %v", addr.String())
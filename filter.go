@@ -0,0 +1,111 @@
+package brts
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var ErrAddressDenied = errors.New("brts: address denied")
+
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func (f *ipFilter) permits(ip net.IP) bool {
+	if containsIP(f.deny, ip) {
+		return false
+	}
+	return len(f.allow) == 0 || containsIP(f.allow, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		if ip == nil {
+			return nil, errors.New("brts: invalid address " + cidr)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(cidr)
+	return n, err
+}
+
+func addNet(nets []*net.IPNet, n *net.IPNet) []*net.IPNet {
+	for _, existing := range nets {
+		if existing.String() == n.String() {
+			return nets
+		}
+	}
+	return append(nets, n)
+}
+
+func removeNet(nets []*net.IPNet, n *net.IPNet) []*net.IPNet {
+	for i, existing := range nets {
+		if existing.String() == n.String() {
+			return append(nets[:i:i], nets[i+1:]...)
+		}
+	}
+	return nets
+}
+
+// Allow adds an address or CIDR range to the allow list. Once the allow list
+// is not empty only matching addresses are accepted.
+func (s *Server) Allow(cidr string) error {
+	n, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.filter.allow = addNet(s.filter.allow, n)
+	s.mu.Unlock()
+	return nil
+}
+
+// Deny adds an address or CIDR range to the deny list, which takes precedence
+// over the allow list. It only affects connections accepted afterwards.
+func (s *Server) Deny(cidr string) error {
+	n, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.filter.deny = addNet(s.filter.deny, n)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) RemoveAllow(cidr string) error {
+	n, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.filter.allow = removeNet(s.filter.allow, n)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *Server) RemoveDeny(cidr string) error {
+	n, err := parseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.filter.deny = removeNet(s.filter.deny, n)
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,64 @@
+package brts
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrFragment = errors.New("brts: malformed fragment")
+
+// FragmentFunc inspects one frame of a fragmented message. It returns the
+// part of the frame that belongs to the message and whether more fragments
+// follow. An error ends the connection.
+type FragmentFunc func(frame []byte) (payload []byte, more bool, err error)
+
+// ContinuationFlag handles fragments whose first byte carries a flag: the
+// message continues while the bits in mask are set. The flag byte is not part
+// of the message.
+func ContinuationFlag(mask byte) FragmentFunc {
+	return func(frame []byte) ([]byte, bool, error) {
+		if len(frame) == 0 {
+			return nil, false, ErrFragment
+		}
+		return frame[1:], frame[0]&mask != 0, nil
+	}
+}
+
+// ReassemblyFramer joins messages that span several frames of another
+// framer, so the message callbacks only see complete messages. A non-zero
+// MaxLength rejects longer messages with ErrFrameTooLarge.
+type ReassemblyFramer struct {
+	Framer    Framer
+	Fragment  FragmentFunc
+	MaxLength int
+}
+
+func (f ReassemblyFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f ReassemblyFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	start := len(dst)
+	for first := true; ; first = false {
+		end := len(dst)
+		data, err := appendFrame(f.Framer, dst, r, false)
+		if err != nil {
+			if err == io.EOF && !first {
+				err = io.ErrUnexpectedEOF
+			}
+			return data[:start], err
+		}
+
+		payload, more, err := f.Fragment(data[end:])
+		if err != nil {
+			return data[:start], err
+		}
+		dst = append(data[:end], payload...)
+		if f.MaxLength > 0 && len(dst)-start > f.MaxLength {
+			return dst[:start], ErrFrameTooLarge
+		}
+		if !more {
+			return dst, nil
+		}
+	}
+}
@@ -0,0 +1,691 @@
+package brts
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+)
+
+var (
+	ErrFrameTooLarge   = errors.New("brts: frame exceeds maximum length")
+	ErrMessageTooLarge = errors.New("brts: message too large")
+)
+
+const (
+	// DefaultMaxFrameLength limits a LengthPrefixFramer frame when no
+	// MaxLength is set.
+	DefaultMaxFrameLength = 16 << 20
+
+	readChunk = 64 << 10
+)
+
+// Framer splits a connection's byte stream into messages. ReadFrame is
+// called repeatedly with the same buffered reader for the connection's
+// lifetime; it returns the next complete message or the error that ended
+// the stream. Datagram connections are not framed, each datagram is a
+// message.
+type Framer interface {
+	ReadFrame(r io.Reader) ([]byte, error)
+}
+
+// FrameAppender is implemented by framers that can append the next frame to
+// a caller supplied buffer. The built-in framers implement it, which lets
+// OnMessage deliver frames in pooled buffers without allocating.
+type FrameAppender interface {
+	AppendFrame(dst []byte, r io.Reader) ([]byte, error)
+}
+
+// FrameEncoder is implemented by framers that can frame an outgoing
+// message, so that Client.Send writes replies the way requests are read.
+// The built-in framers implement it where the framing is reversible.
+type FrameEncoder interface {
+	EncodeFrame(dst, payload []byte) ([]byte, error)
+}
+
+// frameScanner is implemented by framers that can tell whether buf starts
+// with a complete frame without decoding it, so the event engine does not
+// reparse a partial frame on every read. Bytes before scanned were already
+// looked at by an earlier call with a shorter buf. Malformed input counts as
+// complete, for AppendFrame to report.
+type frameScanner interface {
+	frameComplete(buf []byte, scanned int) bool
+}
+
+// FramerFunc adapts an ordinary function to the Framer interface.
+type FramerFunc func(r io.Reader) ([]byte, error)
+
+func (f FramerFunc) ReadFrame(r io.Reader) ([]byte, error) {
+	return f(r)
+}
+
+// DelimFramer ends each message at Delim. The delimiter is kept at the end
+// of the message unless Strip is set. It is the default framing, using the
+// server's message delimiter. A non-zero MaxLength rejects longer messages,
+// not counting the delimiter, with ErrFrameTooLarge as soon as they grow
+// past it.
+type DelimFramer struct {
+	Delim     byte
+	Strip     bool
+	MaxLength int
+
+	skip bool
+}
+
+func (f DelimFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f DelimFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	return SequenceFramer{Delim: []byte{f.Delim}, Strip: f.Strip, MaxLength: f.MaxLength, skip: f.skip}.AppendFrame(dst, r)
+}
+
+func (f DelimFramer) frameComplete(buf []byte, scanned int) bool {
+	return bytes.IndexByte(buf[scanned:], f.Delim) >= 0
+}
+
+func (f DelimFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return SequenceFramer{Delim: []byte{f.Delim}}.EncodeFrame(dst, payload)
+}
+
+// SequenceFramer ends each message at a multi-byte delimiter such as
+// "\r\n". The delimiter is kept at the end of the message unless Strip is
+// set. A non-zero MaxLength rejects longer messages, not counting the
+// delimiter, with ErrFrameTooLarge as soon as they grow past it.
+type SequenceFramer struct {
+	Delim     []byte
+	Strip     bool
+	MaxLength int
+
+	// skip returns a message longer than MaxLength cut to MaxLength+1
+	// bytes, the rest of it discarded unread, for WithMaxMessageSize to
+	// drop or truncate.
+	skip bool
+}
+
+func (f SequenceFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f SequenceFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	if len(f.Delim) == 0 {
+		return dst, errors.New("brts: empty message delimiter")
+	}
+	last := f.Delim[len(f.Delim)-1]
+
+	start := len(dst)
+	var cut, over bool
+	var err error
+	if sr, ok := r.(sliceReader); ok {
+		for {
+			var chunk []byte
+			chunk, err = sr.ReadSlice(last)
+			dst = append(dst, chunk...)
+			if err == bufio.ErrBufferFull {
+				err = nil
+			} else if err != nil {
+				return dst[:start], err
+			}
+			if dst, over, err = f.limit(dst, start); err != nil {
+				return dst, err
+			}
+			cut = cut || over
+			if bytes.HasSuffix(dst[start:], f.Delim) {
+				break
+			}
+		}
+	} else {
+		b := make([]byte, 1)
+		for !bytes.HasSuffix(dst[start:], f.Delim) {
+			if _, err = io.ReadFull(r, b); err != nil {
+				if err == io.ErrUnexpectedEOF {
+					err = io.EOF
+				}
+				return dst[:start], err
+			}
+			dst = append(dst, b[0])
+			if dst, over, err = f.limit(dst, start); err != nil {
+				return dst, err
+			}
+			cut = cut || over
+		}
+	}
+
+	if cut {
+		return dst[:start+f.MaxLength+1], nil
+	}
+	if f.MaxLength > 0 && len(dst)-start-len(f.Delim) > f.MaxLength && !f.skip {
+		return dst[:start], ErrFrameTooLarge
+	}
+	if f.Strip {
+		dst = dst[:len(dst)-len(f.Delim)]
+	}
+	return dst, nil
+}
+
+// limit checks the message received so far against MaxLength, allowing
+// for a delimiter not yet complete. Past it the message fails or, with
+// skip, only its first MaxLength+1 bytes are kept along with the last bytes,
+// which may be the start of the delimiter.
+func (f SequenceFramer) limit(dst []byte, start int) ([]byte, bool, error) {
+	if f.MaxLength <= 0 || len(dst)-start <= f.MaxLength+len(f.Delim) {
+		return dst, false, nil
+	}
+	if !f.skip {
+		return dst[:start], false, ErrFrameTooLarge
+	}
+	keep := start + f.MaxLength + 1
+	return append(dst[:keep], dst[len(dst)-len(f.Delim):]...), true, nil
+}
+
+func (f SequenceFramer) frameComplete(buf []byte, scanned int) bool {
+	// A delimiter may straddle the bytes already scanned.
+	from := max(scanned-len(f.Delim)+1, 0)
+	return len(f.Delim) == 0 || bytes.Index(buf[from:], f.Delim) >= 0
+}
+
+// EncodeFrame appends the delimiter unless payload already ends with it.
+func (f SequenceFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	if len(f.Delim) == 0 {
+		return dst, errors.New("brts: empty message delimiter")
+	}
+	dst = append(dst, payload...)
+	if !bytes.HasSuffix(payload, f.Delim) {
+		dst = append(dst, f.Delim...)
+	}
+	return dst, nil
+}
+
+// LengthPrefixFramer reads messages preceded by their length as a 1, 2 or
+// 4 byte unsigned integer. The prefix is not part of the returned message.
+// Order defaults to big endian. Longer frames than MaxLength are rejected
+// with ErrFrameTooLarge; zero means DefaultMaxFrameLength and a negative
+// MaxLength removes the limit.
+type LengthPrefixFramer struct {
+	Size      int
+	Order     binary.ByteOrder
+	MaxLength int
+}
+
+func (f LengthPrefixFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f LengthPrefixFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	var prefix [4]byte
+	if f.Size != 1 && f.Size != 2 && f.Size != 4 {
+		return dst, fmt.Errorf("brts: invalid length prefix size %d", f.Size)
+	}
+	if _, err := io.ReadFull(r, prefix[:f.Size]); err != nil {
+		return dst, err
+	}
+
+	length := f.length(prefix[:f.Size])
+	if max := f.maxLength(); max >= 0 && length > uint64(max) {
+		return dst, ErrFrameTooLarge
+	}
+	return readFull(dst, r, int(length))
+}
+
+// maxLength returns the frame size limit, or -1 for none.
+func (f LengthPrefixFramer) maxLength() int {
+	switch {
+	case f.MaxLength == 0:
+		return DefaultMaxFrameLength
+	case f.MaxLength < 0:
+		return -1
+	}
+	return f.MaxLength
+}
+
+// length decodes a prefix of f.Size bytes.
+func (f LengthPrefixFramer) length(prefix []byte) uint64 {
+	order := f.Order
+	if order == nil {
+		order = binary.BigEndian
+	}
+	switch len(prefix) {
+	case 1:
+		return uint64(prefix[0])
+	case 2:
+		return uint64(order.Uint16(prefix))
+	default:
+		return uint64(order.Uint32(prefix))
+	}
+}
+
+func (f LengthPrefixFramer) frameComplete(buf []byte, scanned int) bool {
+	if f.Size != 1 && f.Size != 2 && f.Size != 4 {
+		return true
+	}
+	if len(buf) < f.Size {
+		return false
+	}
+	length := f.length(buf[:f.Size])
+	if max := f.maxLength(); max >= 0 && length > uint64(max) {
+		return true
+	}
+	return uint64(len(buf)-f.Size) >= length
+}
+
+func (f LengthPrefixFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	order := f.Order
+	if order == nil {
+		order = binary.BigEndian
+	}
+	if max := f.maxLength(); max >= 0 && len(payload) > max {
+		return dst, ErrFrameTooLarge
+	}
+
+	var prefix [4]byte
+	switch f.Size {
+	case 1:
+		if len(payload) > math.MaxUint8 {
+			return dst, ErrFrameTooLarge
+		}
+		prefix[0] = byte(len(payload))
+	case 2:
+		if len(payload) > math.MaxUint16 {
+			return dst, ErrFrameTooLarge
+		}
+		order.PutUint16(prefix[:2], uint16(len(payload)))
+	case 4:
+		if uint64(len(payload)) > math.MaxUint32 {
+			return dst, ErrFrameTooLarge
+		}
+		order.PutUint32(prefix[:4], uint32(len(payload)))
+	default:
+		return dst, fmt.Errorf("brts: invalid length prefix size %d", f.Size)
+	}
+	dst = append(dst, prefix[:f.Size]...)
+	return append(dst, payload...), nil
+}
+
+// readFull appends exactly n bytes from r to dst.
+// readFull grows dst by at most readChunk bytes at a time, so a peer
+// announcing a large frame has to send it before it is allocated.
+func readFull(dst []byte, r io.Reader, n int) ([]byte, error) {
+	start := len(dst)
+	for len(dst)-start < n {
+		chunk := min(n-(len(dst)-start), readChunk)
+		at := len(dst)
+		dst = slices.Grow(dst, chunk)[:at+chunk]
+		if _, err := io.ReadFull(r, dst[at:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return dst[:start], err
+		}
+	}
+	return dst, nil
+}
+
+// FixedFramer slices the stream into records of Size bytes.
+type FixedFramer struct {
+	Size int
+}
+
+func (f FixedFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f FixedFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	if f.Size <= 0 {
+		return dst, fmt.Errorf("brts: invalid record size %d", f.Size)
+	}
+
+	start := len(dst)
+	dst = slices.Grow(dst, f.Size)[:start+f.Size]
+	if _, err := io.ReadFull(r, dst[start:]); err != nil {
+		return dst[:start], err
+	}
+	return dst, nil
+}
+
+func (f FixedFramer) frameComplete(buf []byte, scanned int) bool {
+	return f.Size <= 0 || len(buf) >= f.Size
+}
+
+// EncodeFrame only accepts payloads of exactly Size bytes.
+func (f FixedFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	if len(payload) != f.Size {
+		return dst, fmt.Errorf("brts: message of %d bytes does not fit a %d byte record", len(payload), f.Size)
+	}
+	return append(dst, payload...), nil
+}
+
+const (
+	STX byte = 0x02
+	ETX byte = 0x03
+	DLE byte = 0x10
+)
+
+// STXFramer reads messages framed as STX payload ETX. Inside the payload a
+// DLE byte escapes the byte that follows it, so STX, ETX and DLE can appear
+// in the data; the returned message is unescaped. Bytes outside a frame are
+// discarded, and an unescaped STX restarts the frame. A non-zero MaxLength
+// rejects longer payloads with ErrFrameTooLarge.
+type STXFramer struct {
+	MaxLength int
+}
+
+func (f STXFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f STXFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return dst, err
+		}
+		if b == STX {
+			break
+		}
+	}
+
+	start := len(dst)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return dst[:start], unexpectedEOF(err)
+		}
+
+		switch b {
+		case STX:
+			dst = dst[:start]
+			continue
+		case ETX:
+			return dst, nil
+		case DLE:
+			if b, err = br.ReadByte(); err != nil {
+				return dst[:start], unexpectedEOF(err)
+			}
+		}
+
+		if f.MaxLength > 0 && len(dst)-start >= f.MaxLength {
+			return dst[:start], ErrFrameTooLarge
+		}
+		dst = append(dst, b)
+	}
+}
+
+// EncodeFrame wraps payload in STX and ETX, escaping control bytes with DLE.
+func (f STXFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	if f.MaxLength > 0 && len(payload) > f.MaxLength {
+		return dst, ErrFrameTooLarge
+	}
+	dst = append(dst, STX)
+	for _, b := range payload {
+		if b == STX || b == ETX || b == DLE {
+			dst = append(dst, DLE)
+		}
+		dst = append(dst, b)
+	}
+	return append(dst, ETX), nil
+}
+
+type byteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (br *byteReader) ReadByte() (byte, error) {
+	if _, err := io.ReadFull(br.r, br.b[:]); err != nil {
+		return 0, err
+	}
+	return br.b[0], nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+const defaultRawReadSize = 4096
+
+// RawFramer does no framing: each message is whatever a single read returns,
+// up to Size bytes (4096 by default). It suits proxies and protocols without
+// discrete messages.
+type RawFramer struct {
+	Size int
+}
+
+func (f RawFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f RawFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	size := f.Size
+	if size <= 0 {
+		size = defaultRawReadSize
+	}
+
+	start := len(dst)
+	grown := slices.Grow(dst, size)
+	buf := grown[start : start+size]
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			return grown[:start+n], nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
+
+func (f RawFramer) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return append(dst, payload...), nil
+}
+
+// SplitFramer frames the stream with a bufio.SplitFunc, as a bufio.Scanner
+// would. Each token must fit in the connection's read buffer.
+type SplitFramer struct {
+	Split bufio.SplitFunc
+}
+
+func (f SplitFramer) ReadFrame(r io.Reader) ([]byte, error) {
+	return f.AppendFrame(nil, r)
+}
+
+func (f SplitFramer) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	pr, ok := r.(peekReader)
+	if !ok {
+		return dst, errors.New("brts: split framing needs a buffered reader")
+	}
+
+	size := 1
+	for {
+		data, err := pr.Peek(max(size, pr.Buffered()))
+		advance, token, serr := f.Split(data, err == io.EOF)
+		if serr != nil && serr != bufio.ErrFinalToken {
+			return dst, serr
+		}
+		if advance < 0 || advance > len(data) {
+			return dst, errors.New("brts: split function advanced out of range")
+		}
+		if token != nil {
+			dst = append(dst, token...)
+			pr.Discard(advance)
+			return dst, nil
+		}
+		if advance > 0 {
+			pr.Discard(advance)
+			size = 1
+			continue
+		}
+
+		switch {
+		case err == bufio.ErrBufferFull:
+			return dst, ErrFrameTooLarge
+		case err != nil:
+			return dst, err
+		}
+		size = len(data) + 1
+	}
+}
+
+// appendFrame reads the next frame from r onto dst. Framers that cannot
+// append have their frame copied, unless dst is nil and the caller accepts
+// a buffer the framer may reuse.
+func appendFrame(framer Framer, dst []byte, r io.Reader, reuse bool) ([]byte, error) {
+	if appender, ok := framer.(FrameAppender); ok {
+		return appender.AppendFrame(dst, r)
+	}
+	data, err := framer.ReadFrame(r)
+	if dst == nil && reuse {
+		return data, err
+	}
+	return append(dst, data...), err
+}
+
+type sliceReader interface {
+	ReadSlice(delim byte) ([]byte, error)
+}
+
+type peekReader interface {
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Buffered() int
+}
+
+// frameReader limits how many bytes a framer may consume for one frame, so
+// a peer cannot make the server buffer an unbounded message.
+type frameReader struct {
+	r   *bufio.Reader
+	max int
+	n   int
+}
+
+func (fr *frameReader) reset() {
+	fr.n = 0
+}
+
+func (fr *frameReader) consume(n int) error {
+	fr.n += n
+	if fr.n > fr.max {
+		return ErrFrameTooLarge
+	}
+	return nil
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	remaining := fr.max - fr.n + 1
+	if remaining <= 0 {
+		return 0, ErrFrameTooLarge
+	}
+	if len(p) > remaining {
+		p = p[:remaining]
+	}
+	n, err := fr.r.Read(p)
+	if cerr := fr.consume(n); cerr != nil {
+		return n, cerr
+	}
+	return n, err
+}
+
+func (fr *frameReader) ReadByte() (byte, error) {
+	b, err := fr.r.ReadByte()
+	if err != nil {
+		return b, err
+	}
+	return b, fr.consume(1)
+}
+
+func (fr *frameReader) ReadSlice(delim byte) ([]byte, error) {
+	chunk, err := fr.r.ReadSlice(delim)
+	if cerr := fr.consume(len(chunk)); cerr != nil {
+		return nil, cerr
+	}
+	return chunk, err
+}
+
+// Peek does not look further than the rest of the frame's allowance, and
+// fails with ErrFrameTooLarge when asked to.
+func (fr *frameReader) Peek(n int) ([]byte, error) {
+	allowed := max(fr.max-fr.n, 0)
+	if n <= allowed {
+		return fr.r.Peek(n)
+	}
+	data, err := fr.r.Peek(allowed)
+	if err == nil {
+		err = ErrFrameTooLarge
+	}
+	return data, err
+}
+
+func (fr *frameReader) Discard(n int) (int, error) {
+	n, err := fr.r.Discard(n)
+	if cerr := fr.consume(n); cerr != nil {
+		return n, cerr
+	}
+	return n, err
+}
+
+func (fr *frameReader) Buffered() int {
+	return fr.r.Buffered()
+}
+
+func (s *Server) SetFramer(framer Framer) {
+	s.framer = framer
+}
+
+// SetFramer overrides the server's framing for this client. It is usually
+// called from OnNewConnection, before the first message is read.
+func (c *Client) SetFramer(framer Framer) {
+	c.mu.Lock()
+	c.framer = framer
+	c.mu.Unlock()
+}
+
+func (s *Server) framerFor(c *Client) Framer {
+	c.mu.Lock()
+	framer := c.framer
+	c.mu.Unlock()
+
+	if framer == nil {
+		framer = s.defaultFramer()
+	}
+	return s.limitMessages(framer)
+}
+
+func (s *Server) defaultFramer() Framer {
+	if s.framer != nil {
+		return s.framer
+	}
+	return DelimFramer{Delim: s.messageDelim}
+}
+
+// limitMessages has the delimiter framers apply WithMaxMessageSize while
+// scanning, so an oversized message is not buffered whole before deliver
+// drops or truncates it.
+func (s *Server) limitMessages(framer Framer) Framer {
+	if s.maxMsgSize <= 0 {
+		return framer
+	}
+	switch f := framer.(type) {
+	case DelimFramer:
+		if f.MaxLength == 0 {
+			f.MaxLength, f.skip = s.maxMsgSize, true
+		}
+		return f
+	case SequenceFramer:
+		if f.MaxLength == 0 {
+			f.MaxLength, f.skip = s.maxMsgSize, true
+		}
+		return f
+	}
+	return framer
+}
@@ -0,0 +1,104 @@
+package brts
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLengthPrefixFramer(t *testing.T) {
+	tests := []struct {
+		name   string
+		framer LengthPrefixFramer
+		in     string
+		want   string
+		err    error
+	}{
+		{"one byte", LengthPrefixFramer{Size: 1}, "\x03abcd", "abc", nil},
+		{"big endian", LengthPrefixFramer{Size: 2}, "\x00\x03abcd", "abc", nil},
+		{"little endian", LengthPrefixFramer{Size: 2, Order: binary.LittleEndian}, "\x03\x00abcd", "abc", nil},
+		{"four bytes", LengthPrefixFramer{Size: 4}, "\x00\x00\x00\x01a", "a", nil},
+		{"empty", LengthPrefixFramer{Size: 1}, "\x00", "", nil},
+		{"too large", LengthPrefixFramer{Size: 2, MaxLength: 2}, "\x00\x03abc", "", ErrFrameTooLarge},
+		{"truncated", LengthPrefixFramer{Size: 2}, "\x00\x03ab", "", io.ErrUnexpectedEOF},
+		{"no frame", LengthPrefixFramer{Size: 2}, "", "", io.EOF},
+	}
+	for _, tt := range tests {
+		frame, err := tt.framer.ReadFrame(strings.NewReader(tt.in))
+		if err != tt.err || string(frame) != tt.want {
+			t.Errorf("%s: ReadFrame = %q, %v; want %q, %v", tt.name, frame, err, tt.want, tt.err)
+		}
+	}
+
+	if _, err := (LengthPrefixFramer{Size: 3}).ReadFrame(strings.NewReader("\x00\x00\x01a")); err == nil {
+		t.Error("ReadFrame accepted a 3 byte prefix")
+	}
+}
+
+func TestLengthPrefixFramerLimit(t *testing.T) {
+	huge := "\xff\xff\xff\xff"
+	if _, err := (LengthPrefixFramer{Size: 4}).ReadFrame(strings.NewReader(huge)); err != ErrFrameTooLarge {
+		t.Fatalf("default limit: %v, want ErrFrameTooLarge", err)
+	}
+
+	// Without a limit the frame is only allocated as it arrives, so the
+	// short stream ends it instead of a 4 GiB allocation.
+	_, err := (LengthPrefixFramer{Size: 4, MaxLength: -1}).ReadFrame(strings.NewReader(huge + "data"))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("unlimited: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestSequenceFramerMaxLength(t *testing.T) {
+	in := "short\r\n" + strings.Repeat("x", 5000) + "\r\nafter\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(in), 16)
+	f := SequenceFramer{Delim: []byte("\r\n"), Strip: true, MaxLength: 10}
+
+	if frame, err := f.ReadFrame(r); err != nil || string(frame) != "short" {
+		t.Fatalf("first frame %q, %v", frame, err)
+	}
+	if _, err := f.ReadFrame(r); err != ErrFrameTooLarge {
+		t.Fatalf("oversized frame: %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestLimitMessagesSkipsOversized(t *testing.T) {
+	s := Create("127.0.0.1:0", WithDelimiter([]byte("\r\n"), true), WithMaxMessageSize(10, false))
+	f := s.limitMessages(s.defaultFramer())
+	in := strings.Repeat("x", 5000) + "\r\nafter\r\n"
+	r := bufio.NewReaderSize(strings.NewReader(in), 16)
+
+	// The oversized message comes back cut to one byte over the limit, for
+	// deliver to drop, and reading resumes after its delimiter.
+	frame, err := f.ReadFrame(r)
+	if err != nil || len(frame) != 11 {
+		t.Fatalf("oversized frame has %d bytes, %v; want 11", len(frame), err)
+	}
+	if frame, err := f.ReadFrame(r); err != nil || string(frame) != "after" {
+		t.Fatalf("next frame %q, %v", frame, err)
+	}
+}
+
+func TestSequenceFramerMaxLengthExcludesDelim(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		f := SequenceFramer{Delim: []byte("\r\n"), Strip: strip, MaxLength: 5}
+		want := "hello"
+		if !strip {
+			want += "\r\n"
+		}
+		if frame, err := f.ReadFrame(strings.NewReader("hello\r\n")); err != nil || string(frame) != want {
+			t.Errorf("strip %v: ReadFrame = %q, %v; want %q", strip, frame, err, want)
+		}
+	}
+}
+
+func TestSequenceFramerErrorKeepsDst(t *testing.T) {
+	f := SequenceFramer{Delim: []byte("\r\n")}
+	for _, r := range []io.Reader{strings.NewReader("partial"), bufio.NewReader(strings.NewReader("partial"))} {
+		if dst, err := f.AppendFrame([]byte("prev"), r); err != io.EOF || string(dst) != "prev" {
+			t.Errorf("%T: AppendFrame = %q, %v; want the buffer as passed in", r, dst, err)
+		}
+	}
+}
@@ -1,3 +1,13 @@
 module github.com/avkspog/brts
 
-go 1.12
+go 1.24.0
+
+require (
+	golang.org/x/crypto v0.48.0
+	golang.org/x/sys v0.41.0
+)
+
+require (
+	golang.org/x/net v0.49.0 // indirect
+	golang.org/x/text v0.34.0 // indirect
+)
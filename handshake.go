@@ -0,0 +1,53 @@
+package brts
+
+import (
+	"bufio"
+	"time"
+)
+
+// DefaultHandshakeTimeout is how long a client has to send its handshake
+// frame when OnHandshake is set.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// awaitHandshake reads the client's first frame and lets OnHandshake decide
+// whether the client is accepted. Bytes read past the frame are kept for
+// the read loop.
+func (s *Server) awaitHandshake(c *Client) error {
+	if s.onHandshake == nil {
+		return nil
+	}
+
+	c.Conn.SetReadDeadline(deadline(s.helloTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	var frame []byte
+	var err error
+	if isDatagram(c.Conn) {
+		buf := make([]byte, maxDatagramSize)
+		var n int
+		n, err = c.Conn.Read(buf)
+		frame = buf[:n]
+	} else {
+		conn := &sniffConn{Conn: c.Conn, reader: bufio.NewReader(c.Conn)}
+		frame, err = appendFrame(s.framerFor(c), nil, s.limitReader(conn.reader), false)
+		if conn.reader.Buffered() > 0 {
+			// Otherwise the connection stays unwrapped, so an event
+			// engine can still take it over.
+			c.Conn = conn
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return s.onHandshake(c, frame)
+}
+
+// OnHandshake makes the server wait for the first frame of every client,
+// such as a login packet or an IMEI announcement, and pass it to callback
+// before OnNewConnection. The client is accepted when callback returns nil
+// and rejected with its error otherwise, as are clients that do not send
+// the frame within the handshake timeout. The frame is not delivered to the
+// message handlers.
+func (s *Server) OnHandshake(callback func(c *Client, frame []byte) error) {
+	s.onHandshake = callback
+}
@@ -0,0 +1,27 @@
+package brts
+
+// idleTimedOut tells OnIdleTimeout that the client stayed silent for its
+// idle timeout and reports whether the callback extended the session.
+func (c *Client) idleTimedOut() bool {
+	c.onIdle(c)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	extended := c.extended
+	c.extended = false
+	return extended
+}
+
+// ExtendIdle keeps a client open whose idle timeout expired, when called
+// from OnIdleTimeout. The client gets another idle timeout to send data.
+func (c *Client) ExtendIdle() {
+	c.mu.Lock()
+	c.extended = true
+	c.mu.Unlock()
+}
+
+// OnIdleTimeout is called when a client stayed silent between messages for
+// its idle timeout, before it is disconnected. The callback may send a
+// final probe, or call ExtendIdle to keep the client.
+func (s *Server) OnIdleTimeout(callback func(c *Client)) {
+	s.onIdleTimeout = callback
+}
@@ -0,0 +1,71 @@
+package brts
+
+import (
+	"context"
+	"sync"
+)
+
+// Kick disconnects the client for the given reason, which CloseReason
+// reports from then on, such as in OnConnectionLost. With a kick message
+// set by WithKickMessage, the client is sent it first, waiting up to a
+// second for it to be written. The error is the first failure to notify or
+// close.
+func (s *Server) Kick(c *Client, reason string) error {
+	c.mu.Lock()
+	c.reason = reason
+	c.mu.Unlock()
+
+	var err error
+	if s.kickMessage != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), goAwayWriteTimeout)
+		if err = c.SendContext(ctx, s.kickMessage(reason)); err == nil {
+			err = c.Flush(ctx)
+		}
+		cancel()
+	}
+	if cerr := c.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// CloseAll kicks every connected client for the given reason, all at once,
+// sending each the kick message first when one is set. It returns the
+// clients that were not notified or closed cleanly with their errors, or
+// nil.
+func (s *Server) CloseAll(reason string) map[*Client]error {
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	var failed map[*Client]error
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			if err := s.Kick(c, reason); err != nil {
+				mu.Lock()
+				if failed == nil {
+					failed = make(map[*Client]error)
+				}
+				failed[c] = err
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return failed
+}
+
+// CloseReason reports why the server disconnected the client, or an empty
+// string.
+func (c *Client) CloseReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.reason
+}
@@ -0,0 +1,123 @@
+package brts
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+var (
+	ErrTooManyClientsPerIP     = errors.New("brts: too many clients from ip")
+	ErrTooManyClientsPerSubnet = errors.New("brts: too many clients from subnet")
+)
+
+type ipLimits struct {
+	maxPerIP     int
+	maxPerSubnet int
+	ipv4Bits     int
+	ipv6Bits     int
+	perIP        map[string]int
+	perSubnet    map[string]int
+}
+
+func newIPLimits() *ipLimits {
+	return &ipLimits{
+		perIP:     make(map[string]int),
+		perSubnet: make(map[string]int),
+	}
+}
+
+func (l *ipLimits) subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(l.ipv4Bits, 32)), Mask: net.CIDRMask(l.ipv4Bits, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(l.ipv6Bits, 128)), Mask: net.CIDRMask(l.ipv6Bits, 128)}).String()
+}
+
+func (l *ipLimits) acquire(ip net.IP) error {
+	key := ip.String()
+	subnet := l.subnet(ip)
+	if l.maxPerIP > 0 && l.perIP[key] >= l.maxPerIP {
+		return ErrTooManyClientsPerIP
+	}
+	if l.maxPerSubnet > 0 && l.perSubnet[subnet] >= l.maxPerSubnet {
+		return ErrTooManyClientsPerSubnet
+	}
+	l.perIP[key]++
+	l.perSubnet[subnet]++
+	return nil
+}
+
+func (l *ipLimits) release(ip net.IP) {
+	key := ip.String()
+	subnet := l.subnet(ip)
+	if l.perIP[key]--; l.perIP[key] <= 0 {
+		delete(l.perIP, key)
+	}
+	if l.perSubnet[subnet]--; l.perSubnet[subnet] <= 0 {
+		delete(l.perSubnet, subnet)
+	}
+}
+
+func peerIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// knownPeerIP returns the remote ip of conn if it can be determined without
+// reading from the connection, which is not the case while a PROXY protocol
+// header is still pending.
+func knownPeerIP(conn net.Conn) (net.IP, bool) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if _, ok := conn.(*proxyConn); ok {
+		return nil, false
+	}
+	return peerIP(conn.RemoteAddr()), true
+}
+
+func (s *Server) admitLocked(c *Client, ip net.IP) error {
+	c.admitted = true
+	if ip == nil {
+		return nil
+	}
+	if !s.filter.permits(ip) {
+		return ErrAddressDenied
+	}
+	if s.ipLimits == nil {
+		return nil
+	}
+	if err := s.ipLimits.acquire(ip); err != nil {
+		return err
+	}
+	c.ip = ip
+	return nil
+}
+
+// admitLate applies the ip filter and per-ip limits to connections whose real address was
+// only known after the PROXY protocol header had been read.
+func (s *Server) admitLate(c *Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.admitted {
+		return nil
+	}
+	return s.admitLocked(c, peerIP(c.Conn.RemoteAddr()))
+}
+
+func (s *Server) releaseLocked(c *Client) {
+	if c.ip != nil && s.ipLimits != nil {
+		s.ipLimits.release(c.ip)
+		c.ip = nil
+	}
+}
+
+func isLimitError(err error) bool {
+	return err == ErrTooManyClients || err == ErrTooManyClientsPerIP || err == ErrTooManyClientsPerSubnet
+}
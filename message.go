@@ -0,0 +1,61 @@
+package brts
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPooledMessage caps the buffer size kept for reuse, so one huge message
+// does not pin its memory in the pool.
+const maxPooledMessage = 64 * 1024
+
+var messagePool = sync.Pool{
+	New: func() any {
+		return &Message{}
+	},
+}
+
+// Message is a received message delivered to OnMessage. Data lives in a
+// pooled buffer that is reused once every reference has been released.
+type Message struct {
+	Data []byte
+
+	client   *Client
+	received time.Time
+	refs     atomic.Int32
+}
+
+func newMessage() *Message {
+	m := messagePool.Get().(*Message)
+	m.Data = m.Data[:0]
+	m.refs.Store(1)
+	return m
+}
+
+// Retain keeps the message alive after the OnMessage callback returns. Each
+// Retain must be matched by a Release.
+func (m *Message) Retain() {
+	m.refs.Add(1)
+}
+
+// Release drops a reference. Data must not be used after the last Release.
+func (m *Message) Release() {
+	switch refs := m.refs.Add(-1); {
+	case refs == 0:
+		if cap(m.Data) > maxPooledMessage {
+			m.Data = nil
+		}
+		m.client = nil
+		messagePool.Put(m)
+	case refs < 0:
+		panic("brts: message released more times than retained")
+	}
+}
+
+// release is Release for a message that may not exist.
+func (m *Message) release() {
+	if m != nil {
+		m.Release()
+	}
+}
@@ -0,0 +1,37 @@
+package brts
+
+// NextFunc passes a message on to the rest of the middleware chain and then
+// the message callback. Middleware may pass different data than it got, for
+// example after decrypting it.
+type NextFunc func(data []byte)
+
+// Middleware wraps message handling. It calls next to continue, or returns
+// without calling it to drop the message.
+type Middleware func(c *Client, data []byte, next NextFunc)
+
+// Use appends middleware that runs, in the order added, around every
+// message before it reaches OnMessageReceive, OnMessage or OnDecoded.
+// Batched messages bypass it. Use must be called before the server is
+// started.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// handle runs the middleware chain and then handler.
+func (s *Server) handle(c *Client, data []byte, handler NextFunc) {
+	if len(s.middleware) == 0 {
+		handler(data)
+		return
+	}
+
+	var next func(i int) NextFunc
+	next = func(i int) NextFunc {
+		if i == len(s.middleware) {
+			return handler
+		}
+		return func(data []byte) {
+			s.middleware[i](c, data, next(i+1))
+		}
+	}
+	next(0)(data)
+}
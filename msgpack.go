@@ -0,0 +1,607 @@
+package brts
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrMsgpack = errors.New("brts: malformed msgpack")
+
+// msgpackMaxDepth bounds the nesting of decoded arrays and maps.
+const msgpackMaxDepth = 256
+
+// MsgpackExt is an extension value the decoder does not interpret.
+type MsgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+// MsgpackCodec reads one MessagePack value per message; values delimit
+// themselves, so no other framing is needed. Decode returns the generic form:
+// nil, bool, int64, uint64, float32, float64, string, []byte, []any,
+// map[string]any (map[any]any when keys are not all strings), time.Time or
+// MsgpackExt. Unmarshal and Marshal plug in a library for typed values,
+// New supplying the value to unmarshal into. A non-zero MaxLength rejects
+// longer messages with ErrFrameTooLarge.
+type MsgpackCodec struct {
+	MaxLength int
+	New       func() any
+	Unmarshal func(data []byte, v any) error
+	Marshal   func(v any) ([]byte, error)
+}
+
+func (c MsgpackCodec) ReadFrame(r io.Reader) ([]byte, error) {
+	return c.AppendFrame(nil, r)
+}
+
+// AppendFrame appends the bytes of the next complete value, reading its
+// headers to learn how much follows.
+func (c MsgpackCodec) AppendFrame(dst []byte, r io.Reader) ([]byte, error) {
+	start := len(dst)
+	read := func(n int) ([]byte, error) {
+		if c.MaxLength > 0 && len(dst)-start+n > c.MaxLength {
+			return nil, ErrFrameTooLarge
+		}
+		var err error
+		if dst, err = readFull(dst, r, n); err != nil {
+			if len(dst) > start || err != io.EOF {
+				err = unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		return dst[len(dst)-n:], nil
+	}
+
+	for pending := uint64(1); pending > 0; pending-- {
+		head, err := read(1)
+		if err != nil {
+			return dst[:start], err
+		}
+
+		size, items, lenBytes, extra, err := msgpackHeader(head[0])
+		if err != nil {
+			return dst[:start], err
+		}
+		if lenBytes > 0 {
+			b, err := read(lenBytes)
+			if err != nil {
+				return dst[:start], err
+			}
+			n := msgpackUint(b)
+			if items > 0 {
+				items *= n
+			} else {
+				size = n
+			}
+		}
+		if size+extra > 0 {
+			if size+extra > math.MaxInt32 {
+				return dst[:start], ErrFrameTooLarge
+			}
+			if _, err := read(int(size + extra)); err != nil {
+				return dst[:start], err
+			}
+		}
+		pending += items
+	}
+	return dst, nil
+}
+
+// msgpackHeader describes what follows a type byte: size payload bytes, or
+// items nested values, either fixed or, when lenBytes is set, read from the
+// next lenBytes bytes (items is then a multiplier). extra bytes follow the
+// length, such as an extension's type.
+func msgpackHeader(b byte) (size, items uint64, lenBytes int, extra uint64, err error) {
+	switch {
+	case b <= 0x7f, b >= 0xe0, b == 0xc0, b == 0xc2, b == 0xc3:
+		return 0, 0, 0, 0, nil
+	case b <= 0x8f:
+		return 0, uint64(b&0x0f) * 2, 0, 0, nil
+	case b <= 0x9f:
+		return 0, uint64(b & 0x0f), 0, 0, nil
+	case b <= 0xbf:
+		return uint64(b & 0x1f), 0, 0, 0, nil
+	}
+
+	switch b {
+	case 0xc4, 0xc5, 0xc6:
+		return 0, 0, 1 << (b - 0xc4), 0, nil
+	case 0xc7, 0xc8, 0xc9:
+		return 0, 0, 1 << (b - 0xc7), 1, nil
+	case 0xca:
+		return 4, 0, 0, 0, nil
+	case 0xcb:
+		return 8, 0, 0, 0, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return 1 << (b - 0xcc), 0, 0, 0, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return 1 << (b - 0xd0), 0, 0, 0, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return 1 + 1<<(b-0xd4), 0, 0, 0, nil
+	case 0xd9, 0xda, 0xdb:
+		return 0, 0, 1 << (b - 0xd9), 0, nil
+	case 0xdc, 0xdd:
+		return 0, 1, 2 << (b - 0xdc), 0, nil
+	case 0xde, 0xdf:
+		return 0, 2, 2 << (b - 0xde), 0, nil
+	}
+	return 0, 0, 0, 0, ErrMsgpack
+}
+
+func msgpackUint(b []byte) uint64 {
+	switch len(b) {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b))
+	default:
+		return binary.BigEndian.Uint64(b)
+	}
+}
+
+// EncodeFrame writes payload as it is: encoded values delimit themselves.
+func (c MsgpackCodec) EncodeFrame(dst, payload []byte) ([]byte, error) {
+	return append(dst, payload...), nil
+}
+
+func (c MsgpackCodec) Decode(data []byte) (any, error) {
+	if c.New != nil && c.Unmarshal != nil {
+		v := c.New()
+		if err := c.Unmarshal(data, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return UnmarshalMsgpack(data)
+}
+
+func (c MsgpackCodec) Encode(v any) ([]byte, error) {
+	if c.Marshal != nil {
+		return c.Marshal(v)
+	}
+	return AppendMsgpack(nil, v)
+}
+
+// UnmarshalMsgpack decodes a single MessagePack value into its generic form.
+func UnmarshalMsgpack(data []byte) (any, error) {
+	d := &msgpackDecoder{data: data}
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(data) {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMsgpack, len(data)-d.pos)
+	}
+	return v, nil
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) next(n uint64) ([]byte, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrMsgpack)
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+func (d *msgpackDecoder) uint(n uint64) (uint64, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	return msgpackUint(b), nil
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, fmt.Errorf("%w: nested too deeply", ErrMsgpack)
+	}
+	head, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	b := head[0]
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b <= 0x8f:
+		return d.mapValue(uint64(b&0x0f), depth)
+	case b <= 0x9f:
+		return d.array(uint64(b&0x0f), depth)
+	case b <= 0xbf:
+		s, err := d.next(uint64(b & 0x1f))
+		return string(s), err
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := d.next(n)
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), bin...), nil
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(n)
+	case 0xca:
+		n, err := d.uint(4)
+		return math.Float32frombits(uint32(n)), err
+	case 0xcb:
+		n, err := d.uint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (b - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := uint64(1) << (b - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(n)
+		return string(s), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(n, depth)
+	}
+	return nil, fmt.Errorf("%w: invalid type byte %#x", ErrMsgpack, b)
+}
+
+func (d *msgpackDecoder) array(n uint64, depth int) (any, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return nil, fmt.Errorf("%w: unexpected end", ErrMsgpack)
+	}
+	list := make([]any, n)
+	for i := range list {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = v
+	}
+	return list, nil
+}
+
+func (d *msgpackDecoder) mapValue(n uint64, depth int) (any, error) {
+	if n > uint64(len(d.data)-d.pos)/2 {
+		return nil, fmt.Errorf("%w: unexpected end", ErrMsgpack)
+	}
+	keys := make([]any, n)
+	values := make([]any, n)
+	strs := true
+	for i := range keys {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch key := k.(type) {
+		case string:
+		case []byte:
+			k = string(key)
+			strs = false
+		case []any, map[string]any, map[any]any, MsgpackExt:
+			return nil, fmt.Errorf("%w: unhashable map key", ErrMsgpack)
+		default:
+			strs = false
+		}
+		keys[i], values[i] = k, v
+	}
+
+	if strs {
+		m := make(map[string]any, n)
+		for i, k := range keys {
+			m[k.(string)] = values[i]
+		}
+		return m, nil
+	}
+	m := make(map[any]any, n)
+	for i, k := range keys {
+		m[k] = values[i]
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) ext(n uint64) (any, error) {
+	typ, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ[0]) != -1 {
+		return MsgpackExt{Type: int8(typ[0]), Data: append([]byte(nil), data...)}, nil
+	}
+	switch len(data) {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data))), nil
+	}
+	return nil, fmt.Errorf("%w: invalid timestamp", ErrMsgpack)
+}
+
+// AppendMsgpack appends the MessagePack encoding of v. It handles the values
+// UnmarshalMsgpack returns, other integer and float types, slices, arrays,
+// maps and structs; struct fields are named by their msgpack tag or field
+// name, and a tag of "-" skips the field.
+func AppendMsgpack(dst []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(dst, 0xc0), nil
+	case bool:
+		if v {
+			return append(dst, 0xc3), nil
+		}
+		return append(dst, 0xc2), nil
+	case string:
+		return appendMsgpackString(dst, v), nil
+	case []byte:
+		return appendMsgpackBytes(dst, v), nil
+	case time.Time:
+		return appendMsgpackTime(dst, v), nil
+	case MsgpackExt:
+		return appendMsgpackExt(dst, v), nil
+	}
+	return appendMsgpackValue(dst, reflect.ValueOf(v), 0)
+}
+
+func appendMsgpackValue(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	if depth > msgpackMaxDepth {
+		return dst, fmt.Errorf("brts: msgpack value nested too deeply")
+	}
+
+	switch v.Kind() {
+	case reflect.Invalid:
+		return append(dst, 0xc0), nil
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return append(dst, 0xc0), nil
+		}
+		return appendMsgpackValue(dst, v.Elem(), depth+1)
+	case reflect.Bool:
+		return AppendMsgpack(dst, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendMsgpackInt(dst, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendMsgpackUint(dst, v.Uint()), nil
+	case reflect.Float32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xca), math.Float32bits(float32(v.Float()))), nil
+	case reflect.Float64:
+		return binary.BigEndian.AppendUint64(append(dst, 0xcb), math.Float64bits(v.Float())), nil
+	case reflect.String:
+		return appendMsgpackString(dst, v.String()), nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return append(dst, 0xc0), nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			return appendMsgpackBytes(dst, b), nil
+		}
+		dst = appendMsgpackLen(dst, v.Len(), 0x90, 0xdc)
+		for i := 0; i < v.Len(); i++ {
+			var err error
+			if dst, err = appendMsgpackValue(dst, v.Index(i), depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return append(dst, 0xc0), nil
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		dst = appendMsgpackLen(dst, len(keys), 0x80, 0xde)
+		for _, k := range keys {
+			var err error
+			if dst, err = appendMsgpackValue(dst, k, depth+1); err != nil {
+				return dst, err
+			}
+			if dst, err = appendMsgpackValue(dst, v.MapIndex(k), depth+1); err != nil {
+				return dst, err
+			}
+		}
+		return dst, nil
+	case reflect.Struct:
+		switch sv := v.Interface().(type) {
+		case time.Time:
+			return appendMsgpackTime(dst, sv), nil
+		case MsgpackExt:
+			return appendMsgpackExt(dst, sv), nil
+		}
+		return appendMsgpackStruct(dst, v, depth)
+	}
+	return dst, fmt.Errorf("brts: can not encode %s as msgpack", v.Type())
+}
+
+func appendMsgpackStruct(dst []byte, v reflect.Value, depth int) ([]byte, error) {
+	t := v.Type()
+	var names []string
+	var fields []reflect.Value
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("msgpack"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		names = append(names, name)
+		fields = append(fields, v.Field(i))
+	}
+
+	dst = appendMsgpackLen(dst, len(names), 0x80, 0xde)
+	for i, name := range names {
+		dst = appendMsgpackString(dst, name)
+		var err error
+		if dst, err = appendMsgpackValue(dst, fields[i], depth+1); err != nil {
+			return dst, err
+		}
+	}
+	return dst, nil
+}
+
+// appendMsgpackLen appends an array or map header: fix is the type byte of
+// the fixed form, wide that of the 16 bit form, followed by the 32 bit one.
+func appendMsgpackLen(dst []byte, n int, fix, wide byte) []byte {
+	switch {
+	case n < 16:
+		return append(dst, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, wide), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(dst, wide+1), uint32(n))
+	}
+}
+
+func appendMsgpackInt(dst []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendMsgpackUint(dst, uint64(n))
+	case n >= -32:
+		return append(dst, byte(n))
+	case n >= math.MinInt8:
+		return append(dst, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(n))
+	}
+}
+
+func appendMsgpackUint(dst []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(dst, byte(n))
+	case n <= math.MaxUint8:
+		return append(dst, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(dst, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xce), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(dst, 0xcf), n)
+	}
+}
+
+func appendMsgpackString(dst []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xda), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xdb), uint32(n))
+	}
+	return append(dst, s...)
+}
+
+func appendMsgpackBytes(dst, b []byte) []byte {
+	switch n := len(b); {
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		dst = binary.BigEndian.AppendUint16(append(dst, 0xc5), uint16(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xc6), uint32(n))
+	}
+	return append(dst, b...)
+}
+
+func appendMsgpackExt(dst []byte, ext MsgpackExt) []byte {
+	switch n := len(ext.Data); n {
+	case 1, 2, 4, 8, 16:
+		var code byte
+		for size := n; size > 1; size >>= 1 {
+			code++
+		}
+		dst = append(dst, 0xd4+code)
+	default:
+		switch {
+		case n <= math.MaxUint8:
+			dst = append(dst, 0xc7, byte(n))
+		case n <= math.MaxUint16:
+			dst = binary.BigEndian.AppendUint16(append(dst, 0xc8), uint16(n))
+		default:
+			dst = binary.BigEndian.AppendUint32(append(dst, 0xc9), uint32(n))
+		}
+	}
+	dst = append(dst, byte(ext.Type))
+	return append(dst, ext.Data...)
+}
+
+// appendMsgpackTime uses the 96 bit timestamp extension, which holds any
+// time.Time.
+func appendMsgpackTime(dst []byte, t time.Time) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(t.Nanosecond()))
+	data = binary.BigEndian.AppendUint64(data, uint64(t.Unix()))
+	return appendMsgpackExt(dst, MsgpackExt{Type: -1, Data: data})
+}
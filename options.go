@@ -0,0 +1,776 @@
+package brts
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+type Option func(s *Server) error
+
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// WithIdleTimeout sets how long a client may stay silent between messages.
+// Zero disables the idle timeout.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return errors.New("brts: idle timeout must not be negative")
+		}
+		s.idleTimeout = timeout
+		return nil
+	}
+}
+
+// WithReadTimeout limits how long a client may stall in the middle of a
+// message. Without it the idle timeout applies there as well.
+func WithReadTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return errors.New("brts: read timeout must be positive")
+		}
+		s.readTimeout = timeout
+		return nil
+	}
+}
+
+// WithWriteTimeout bounds each Client.Write.
+func WithWriteTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return errors.New("brts: write timeout must be positive")
+		}
+		s.writeTimeout = timeout
+		return nil
+	}
+}
+
+// WithFrameTimeout disconnects clients that take longer than timeout to
+// deliver a message once its first byte has arrived.
+func WithFrameTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout <= 0 {
+			return errors.New("brts: frame timeout must be positive")
+		}
+		s.frameTimeout = timeout
+		return nil
+	}
+}
+
+// WithMinReadRate disconnects clients that deliver fewer than bytes per
+// interval while a message is partly received.
+func WithMinReadRate(bytes int, interval time.Duration) Option {
+	return func(s *Server) error {
+		if bytes <= 0 || interval <= 0 {
+			return errors.New("brts: minimum read rate must be positive")
+		}
+		s.minReadRate = bytes
+		s.rateInterval = interval
+		return nil
+	}
+}
+
+func WithAddresses(addresses ...string) Option {
+	return func(s *Server) error {
+		s.addresses = append(s.addresses, addresses...)
+		return nil
+	}
+}
+
+func WithSocketPermissions(mode os.FileMode) Option {
+	return func(s *Server) error {
+		if mode&^os.ModePerm != 0 {
+			return errors.New("brts: socket permissions must only contain permission bits")
+		}
+		s.socketMode = mode
+		return nil
+	}
+}
+
+// WithProxyProtocol expects a PROXY protocol header on every connection
+// accepted on the given listening addresses, as passed to Create or
+// WithAddresses, or on all stream listeners when none are given. Other
+// listeners take direct connections.
+func WithProxyProtocol(addresses ...string) Option {
+	return func(s *Server) error {
+		if len(addresses) == 0 {
+			s.proxyProto = true
+		}
+		s.proxyAddrs = append(s.proxyAddrs, addresses...)
+		return nil
+	}
+}
+
+// WithReusePort opens count listening sockets with SO_REUSEPORT for every TCP
+// address and runs an accept loop on each of them.
+func WithReusePort(count int) Option {
+	return func(s *Server) error {
+		if count < 1 {
+			return errors.New("brts: reuse port count must be at least 1")
+		}
+		s.reusePort = count
+		return nil
+	}
+}
+
+func WithListenConfig(lc *net.ListenConfig) Option {
+	return func(s *Server) error {
+		if lc == nil {
+			return errors.New("brts: listen config must not be nil")
+		}
+		s.listenConfig = lc
+		return nil
+	}
+}
+
+// WithControl adds a function that is called on every listening socket
+// before it is bound, e.g. to set socket options.
+func WithControl(control func(network, address string, c syscall.RawConn) error) Option {
+	return func(s *Server) error {
+		if control == nil {
+			return errors.New("brts: control function must not be nil")
+		}
+		lc := &net.ListenConfig{}
+		if s.listenConfig != nil {
+			*lc = *s.listenConfig
+		}
+		lc.Control = chainControl(lc.Control, control)
+		s.listenConfig = lc
+		return nil
+	}
+}
+
+func WithAcceptRate(perSecond int) Option {
+	return func(s *Server) error {
+		if perSecond <= 0 {
+			return errors.New("brts: accept rate must be positive")
+		}
+		s.acceptRate = newTokenBucket(float64(perSecond), float64(perSecond))
+		return nil
+	}
+}
+
+func WithMessageDelim(delim byte) Option {
+	return func(s *Server) error {
+		s.messageDelim = delim
+		return nil
+	}
+}
+
+// WithDelimiter frames messages on a multi-byte delimiter, optionally
+// stripping it from the message passed to OnMessageReceive.
+func WithDelimiter(delim []byte, strip bool) Option {
+	return func(s *Server) error {
+		if len(delim) == 0 {
+			return errors.New("brts: empty message delimiter")
+		}
+		s.framer = SequenceFramer{Delim: delim, Strip: strip}
+		return nil
+	}
+}
+
+// WithFramer replaces delimiter framing with framer for all connections.
+func WithFramer(framer Framer) Option {
+	return func(s *Server) error {
+		s.framer = framer
+		return nil
+	}
+}
+
+// WithDecoder decodes every message for OnDecoded. When the decoder is also
+// a Framer it replaces the server's framing, and when it is an Encoder it
+// encodes for Client.WriteValue.
+func WithDecoder(decoder Decoder) Option {
+	return func(s *Server) error {
+		s.decoder = decoder
+		if framer, ok := decoder.(Framer); ok {
+			s.framer = framer
+		}
+		if encoder, ok := decoder.(Encoder); ok {
+			s.encoder = encoder
+		}
+		return nil
+	}
+}
+
+func WithEncoder(encoder Encoder) Option {
+	return func(s *Server) error {
+		s.encoder = encoder
+		return nil
+	}
+}
+
+// WithSplitFunc frames messages with a bufio.SplitFunc, such as
+// bufio.ScanLines or a custom one.
+func WithSplitFunc(split bufio.SplitFunc) Option {
+	return func(s *Server) error {
+		if split == nil {
+			return errors.New("brts: split function must not be nil")
+		}
+		s.framer = SplitFramer{Split: split}
+		return nil
+	}
+}
+
+func WithSignalHandling(enabled bool) Option {
+	return func(s *Server) error {
+		s.handleSignal = enabled
+		return nil
+	}
+}
+
+// WithGracefulUpgrade makes the server call Upgrade when the process receives
+// SIGUSR2.
+func WithGracefulUpgrade(enabled bool) Option {
+	return func(s *Server) error {
+		s.upgradeOnSig = enabled
+		return nil
+	}
+}
+
+func WithMaxClients(max int) Option {
+	return func(s *Server) error {
+		if max < 0 {
+			return errors.New("brts: max clients must not be negative")
+		}
+		s.maxClients = max
+		return nil
+	}
+}
+
+// WithMaxMessageSize limits the size of a received message. Longer messages
+// are dropped, or cut to size when truncate is set, and reported to
+// OnMessageError.
+func WithMaxMessageSize(size int, truncate bool) Option {
+	return func(s *Server) error {
+		if size < 0 {
+			return errors.New("brts: max message size must not be negative")
+		}
+		s.maxMsgSize = size
+		s.truncateMsgs = truncate
+		return nil
+	}
+}
+
+// WithReadBufferSize sets the size of each connection's read buffer and the
+// most bytes a framer may read for a single frame. A connection sending a
+// longer frame is closed with ErrFrameTooLarge. Zero keeps the default.
+func WithReadBufferSize(size, max int) Option {
+	return func(s *Server) error {
+		if size < 0 || max < 0 {
+			return errors.New("brts: read buffer size must not be negative")
+		}
+		s.readBufSize = size
+		s.maxReadSize = max
+		return nil
+	}
+}
+
+// WithCopyPayload controls whether OnMessageReceive gets a copy of each
+// message it may keep, which is the default. When disabled the message is
+// read into a buffer reused for the connection's next message, so it must
+// not be used after the callback returns.
+func WithCopyPayload(enabled bool) Option {
+	return func(s *Server) error {
+		s.copyPayload = enabled
+		return nil
+	}
+}
+
+// WithWorkers runs message callbacks on a pool of workers goroutines
+// instead of each connection's read loop, capping handler concurrency.
+// Each client's messages are handled one at a time in arrival order while
+// different clients run in parallel. Once queueSize of a client's messages
+// are waiting, reading from it pauses until half of them are handled.
+func WithWorkers(workers, queueSize int) Option {
+	return func(s *Server) error {
+		if workers < 0 || queueSize < 0 {
+			return errors.New("brts: worker count and queue size must not be negative")
+		}
+		s.workers = workers
+		if s.highWater == 0 {
+			s.highWater = queueSize
+			s.lowWater = queueSize / 2
+		}
+		return nil
+	}
+}
+
+// WithBackpressure sets when a client's reading pauses with WithWorkers: at
+// highWater queued messages, resuming once no more than lowWater remain.
+// Meanwhile TCP flow control pushes back on the peer.
+func WithBackpressure(highWater, lowWater int) Option {
+	return func(s *Server) error {
+		if highWater < 1 || lowWater < 0 || lowWater >= highWater {
+			return errors.New("brts: backpressure needs 0 <= lowWater < highWater")
+		}
+		s.highWater = highWater
+		s.lowWater = lowWater
+		return nil
+	}
+}
+
+// WithWriteQueue gives every client a queue of up to capacity outbound
+// messages, written by a goroutine of its own, so a slow receiver does not
+// hold up the callbacks writing to it. policy decides what happens when
+// the queue is full.
+func WithWriteQueue(capacity int, policy QueuePolicy) Option {
+	return func(s *Server) error {
+		if capacity < 0 {
+			return errors.New("brts: write queue capacity must not be negative")
+		}
+		s.writeQueue = capacity
+		s.queuePolicy = policy
+		return nil
+	}
+}
+
+// WithWriteCoalescing joins queued messages of a client into writes of up
+// to maxBytes, so many small messages cost one system call. With a non-zero
+// interval the writer waits that long after a message is queued for more
+// to join it. Writes are queued as with WithWriteQueue, by default in a
+// blocking queue of 1024 messages.
+func WithWriteCoalescing(maxBytes int, interval time.Duration) Option {
+	return func(s *Server) error {
+		if maxBytes <= 0 || interval < 0 {
+			return errors.New("brts: write coalescing needs a positive size and a non-negative interval")
+		}
+		s.coalesceSize = maxBytes
+		s.flushDelay = interval
+		if s.writeQueue == 0 {
+			s.writeQueue = defaultCoalesceQueue
+		}
+		return nil
+	}
+}
+
+// WithWriteRate limits how many bytes and messages per second are written
+// to each client, so one busy consumer cannot saturate the uplink. Zero
+// leaves either unlimited. Client.SetWriteRate changes a client's limits.
+func WithWriteRate(bytesPerSecond, messagesPerSecond int) Option {
+	return func(s *Server) error {
+		if bytesPerSecond < 0 || messagesPerSecond < 0 {
+			return errors.New("brts: write rates must not be negative")
+		}
+		s.writeBytes = bytesPerSecond
+		s.writeMsgs = messagesPerSecond
+		return nil
+	}
+}
+
+// WithBandwidth caps the bytes per second the server reads from and writes
+// to all its clients together, so it can share a constrained link. Zero
+// leaves a direction unlimited. Reading pauses when over the cap, letting
+// TCP flow control slow the peers down.
+func WithBandwidth(ingressPerSecond, egressPerSecond int) Option {
+	return func(s *Server) error {
+		if ingressPerSecond < 0 || egressPerSecond < 0 {
+			return errors.New("brts: bandwidth must not be negative")
+		}
+		s.ingress = rateBucket(ingressPerSecond)
+		s.egress = rateBucket(egressPerSecond)
+		return nil
+	}
+}
+
+// WithRPC enables Server.Call, tagging requests and matching responses
+// with the given correlator.
+func WithRPC(correlator Correlator) Option {
+	return func(s *Server) error {
+		if correlator == nil {
+			return errors.New("brts: correlator must not be nil")
+		}
+		s.rpc = correlator
+		return nil
+	}
+}
+
+// WithAck enables Client.SendWithAck: a send is acknowledged by the peer
+// answering with the ack frame, and retried up to retries times when it is
+// not.
+func WithAck(ack []byte, retries int) Option {
+	return func(s *Server) error {
+		if len(ack) == 0 || retries < 0 {
+			return errors.New("brts: ack needs a frame and a non-negative retry count")
+		}
+		s.ackFrame = ack
+		s.ackRetries = retries
+		return nil
+	}
+}
+
+// WithOutbox keeps messages sent with SendTo to offline devices in store
+// until the device is bound again. Messages expire after ttl, and a device
+// holds at most maxMessages of them in maxBytes; zero leaves a limit off.
+// SendTo fails with ErrOutboxFull once a device's outbox is full.
+func WithOutbox(store OutboxStore, ttl time.Duration, maxMessages, maxBytes int) Option {
+	return func(s *Server) error {
+		if store == nil || ttl < 0 || maxMessages < 0 || maxBytes < 0 {
+			return errors.New("brts: outbox needs a store and non-negative limits")
+		}
+		s.outbox = &outbox{
+			mu:       &sync.Mutex{},
+			store:    store,
+			ttl:      ttl,
+			maxMsgs:  maxMessages,
+			maxBytes: maxBytes,
+			sending:  make(map[string]bool),
+		}
+		return nil
+	}
+}
+
+// WithClientBudget disconnects clients holding more than maxQueuedBytes in
+// received messages waiting for a worker and messages waiting in their
+// write queue, or starting more than maxGoroutines goroutines with
+// Client.Go at a time. Zero leaves a limit off.
+func WithClientBudget(maxQueuedBytes, maxGoroutines int) Option {
+	return func(s *Server) error {
+		if maxQueuedBytes < 0 || maxGoroutines < 0 {
+			return errors.New("brts: client budget must not be negative")
+		}
+		s.budget = clientBudget{queued: maxQueuedBytes, goroutines: maxGoroutines}
+		return nil
+	}
+}
+
+// WithAuthDeadline disconnects clients that are not authenticated with
+// Client.Authenticate within timeout of connecting.
+func WithAuthDeadline(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return errors.New("brts: authentication deadline must not be negative")
+		}
+		s.authTimeout = timeout
+		return nil
+	}
+}
+
+// WithHandshakeTimeout sets how long clients have to send the frame
+// OnHandshake waits for, DefaultHandshakeTimeout by default.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(s *Server) error {
+		if timeout < 0 {
+			return errors.New("brts: handshake timeout must not be negative")
+		}
+		s.helloTimeout = timeout
+		return nil
+	}
+}
+
+// WithSessionRetention gives every client a session token and keeps the
+// session of a disconnected client for retention, so a client presenting
+// the token to Server.ResumeSession picks up where it left off.
+func WithSessionRetention(retention time.Duration) Option {
+	return func(s *Server) error {
+		if retention < 0 {
+			return errors.New("brts: session retention must not be negative")
+		}
+		s.retention = retention
+		return nil
+	}
+}
+
+// WithSessionLimits keeps at most maxSessions sessions of disconnected
+// clients; further clients disconnecting leave none. Each session keeps
+// the newest of the messages queued for the client within maxUnsentBytes.
+// Zero leaves a limit off. The defaults are DefaultMaxSessions and
+// DefaultSessionUnsent.
+func WithSessionLimits(maxSessions, maxUnsentBytes int) Option {
+	return func(s *Server) error {
+		if maxSessions < 0 || maxUnsentBytes < 0 {
+			return errors.New("brts: session limits must not be negative")
+		}
+		s.maxSessions = maxSessions
+		s.sessionBytes = maxUnsentBytes
+		return nil
+	}
+}
+
+// WithBatching sets when OnMessageBatch is called: once size messages are
+// collected or interval after the first of them arrived, whichever comes
+// first. Either may be zero, but not both.
+func WithBatching(size int, interval time.Duration) Option {
+	return func(s *Server) error {
+		if size < 0 || interval < 0 || size == 0 && interval == 0 {
+			return errors.New("brts: batching needs a positive size or interval")
+		}
+		s.batchSize = size
+		s.batchDelay = interval
+		return nil
+	}
+}
+
+// WithEngine selects how connections are read, see Engine.
+func WithEngine(engine Engine) Option {
+	return func(s *Server) error {
+		if !engineSupported(engine) {
+			return ErrEngineUnsupported
+		}
+		s.engine = engine
+		return nil
+	}
+}
+
+// WithIdleEviction makes room for new connections once MaxClients is
+// reached by evicting the client idle the longest, judged by when it last
+// sent or was sent data. Clients idle for less than minIdle are not
+// evicted.
+func WithIdleEviction(minIdle time.Duration) Option {
+	return func(s *Server) error {
+		if minIdle < 0 {
+			return errors.New("brts: minimum idle time must not be negative")
+		}
+		s.evictIdle = true
+		s.evictAfter = minIdle
+		return nil
+	}
+}
+
+func WithMaxClientsPerIP(max int) Option {
+	return func(s *Server) error {
+		if max < 0 {
+			return errors.New("brts: max clients per ip must not be negative")
+		}
+		if s.ipLimits == nil {
+			s.ipLimits = newIPLimits()
+		}
+		s.ipLimits.maxPerIP = max
+		return nil
+	}
+}
+
+// WithMaxClientsPerSubnet limits the connections from one subnet, grouping
+// IPv4 addresses by ipv4Bits and IPv6 addresses by ipv6Bits prefix length.
+func WithMaxClientsPerSubnet(max, ipv4Bits, ipv6Bits int) Option {
+	return func(s *Server) error {
+		if max < 0 {
+			return errors.New("brts: max clients per subnet must not be negative")
+		}
+		if ipv4Bits < 0 || ipv4Bits > 32 || ipv6Bits < 0 || ipv6Bits > 128 {
+			return errors.New("brts: invalid subnet prefix length")
+		}
+		if s.ipLimits == nil {
+			s.ipLimits = newIPLimits()
+		}
+		s.ipLimits.maxPerSubnet = max
+		s.ipLimits.ipv4Bits = ipv4Bits
+		s.ipLimits.ipv6Bits = ipv6Bits
+		return nil
+	}
+}
+
+func WithAllowList(cidrs ...string) Option {
+	return func(s *Server) error {
+		for _, cidr := range cidrs {
+			if err := s.Allow(cidr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func WithDenyList(cidrs ...string) Option {
+	return func(s *Server) error {
+		for _, cidr := range cidrs {
+			if err := s.Deny(cidr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// WithBusyMessage sets a payload that is written to connections rejected
+// because the server or per-ip client limit was reached.
+func WithBusyMessage(payload []byte) Option {
+	return func(s *Server) error {
+		s.busyMessage = payload
+		return nil
+	}
+}
+
+// WithKickMessage sets how the final frame sent to clients disconnected
+// with Kick is built from the reason. It is framed like Send.
+func WithKickMessage(message func(reason string) []byte) Option {
+	return func(s *Server) error {
+		s.kickMessage = message
+		return nil
+	}
+}
+
+// WithGoAwayMessage sets a payload that is sent to every connected client
+// when the server starts draining or shutting down.
+func WithGoAwayMessage(payload []byte) Option {
+	return func(s *Server) error {
+		s.goAwayMsg = payload
+		return nil
+	}
+}
+
+// WithCompression lists the compressions Client.NegotiateCompression may
+// choose, most preferred first. Each must be registered.
+func WithCompression(names ...string) Option {
+	return func(s *Server) error {
+		for _, name := range names {
+			if _, ok := lookupCompression(name); !ok {
+				return fmt.Errorf("brts: unknown compression %q", name)
+			}
+		}
+		s.compressions = names
+		return nil
+	}
+}
+
+// WithDecompression decompresses inbound streams that start compressed in
+// one of the given formats, "gzip" or "zlib", before they are framed. No
+// formats means gzip only; zlib's two byte header can match plain text and
+// should only be enabled for binary protocols. A stream that inflates to
+// more than maxRatio times its compressed size is closed with
+// ErrDecompressionLimit; zero disables the check.
+func WithDecompression(maxRatio int, formats ...string) Option {
+	return func(s *Server) error {
+		if maxRatio < 0 {
+			return errors.New("brts: decompression ratio must not be negative")
+		}
+		for _, format := range formats {
+			if format != "gzip" && format != "zlib" {
+				return fmt.Errorf("brts: can not detect compression %q", format)
+			}
+		}
+		if len(formats) == 0 {
+			formats = []string{"gzip"}
+		}
+		s.inflate = formats
+		s.inflateRatio = maxRatio
+		return nil
+	}
+}
+
+// WithNACK sets a payload that is written back for every frame that fails
+// validation, such as a checksum mismatch.
+func WithNACK(payload []byte) Option {
+	return func(s *Server) error {
+		s.nackMessage = payload
+		return nil
+	}
+}
+
+func WithLogger(logger Logger) Option {
+	return func(s *Server) error {
+		if logger == nil {
+			return errors.New("brts: logger must not be nil")
+		}
+		s.logger = logger
+		return nil
+	}
+}
+
+func WithTLS(config *tls.Config) Option {
+	return func(s *Server) error {
+		if config == nil {
+			return errors.New("brts: tls config must not be nil")
+		}
+		if s.acmeManaged {
+			return errTLSAndAutocert
+		}
+		// Keep a copy, so certificates added later, such as by StartTLS,
+		// never reach the caller's config.
+		s.tlsConfig = config.Clone()
+		return nil
+	}
+}
+
+// WithTLSDetection lets a server with a TLS configuration serve plaintext
+// clients on the same port: connections that do not open with a TLS
+// handshake are served unencrypted.
+func WithTLSDetection(enabled bool) Option {
+	return func(s *Server) error {
+		s.detectTLS = enabled
+		return nil
+	}
+}
+
+func WithClientAuth(auth tls.ClientAuthType, cas *x509.CertPool) Option {
+	return func(s *Server) error {
+		if auth >= tls.VerifyClientCertIfGiven && cas == nil {
+			return errors.New("brts: client certificate verification requires a CA pool")
+		}
+		s.clientAuth = auth
+		s.clientCAs = cas
+		return nil
+	}
+}
+
+func WithCertificateFiles(certFile, keyFile string) Option {
+	return func(s *Server) error {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		s.setGetCertificate(reloader.GetCertificate)
+		return nil
+	}
+}
+
+func WithGetCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) Option {
+	return func(s *Server) error {
+		if getCertificate == nil {
+			return errors.New("brts: GetCertificate must not be nil")
+		}
+		s.setGetCertificate(getCertificate)
+		return nil
+	}
+}
+
+// WithAutocert obtains and renews certificates for the given hosts from Let's
+// Encrypt. Certificates are stored in cache, which may be nil to keep them in
+// memory only. Challenges are answered with tls-alpn-01, so the server has to
+// be reachable on port 443.
+func WithAutocert(cache autocert.Cache, hosts ...string) Option {
+	return func(s *Server) error {
+		if len(hosts) == 0 {
+			return errors.New("brts: autocert requires at least one host")
+		}
+		return WithAutocertManager(&autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(hosts...),
+			Cache:      cache,
+		})(s)
+	}
+}
+
+var errTLSAndAutocert = errors.New("brts: autocert can not be combined with another tls config")
+
+func WithAutocertManager(manager *autocert.Manager) Option {
+	return func(s *Server) error {
+		if manager == nil {
+			return errors.New("brts: autocert manager must not be nil")
+		}
+		if s.tlsConfig != nil {
+			return errTLSAndAutocert
+		}
+		s.tlsConfig = manager.TLSConfig()
+		s.acmeManaged = true
+		return nil
+	}
+}
@@ -0,0 +1,279 @@
+package brts
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var ErrOutboxFull = errors.New("brts: outbox full")
+
+// OutboxMessage is a message stored for a device that was offline.
+type OutboxMessage struct {
+	Data []byte
+	// Expires is when the message is discarded undelivered. Zero keeps it
+	// until it is delivered.
+	Expires time.Time
+}
+
+// OutboxStore persists the messages waiting for offline devices. Calls are
+// serialised by the server.
+type OutboxStore interface {
+	// Load returns the device's messages, oldest first.
+	Load(device string) ([]OutboxMessage, error)
+	// Store replaces the device's messages. An empty msgs removes them.
+	Store(device string, msgs []OutboxMessage) error
+}
+
+// OutboxAppender is implemented by stores that can add a message without
+// rewriting the device's messages. The outbox prefers it over Store.
+type OutboxAppender interface {
+	// Append stores msg after the device's messages.
+	Append(device string, msg OutboxMessage) error
+}
+
+// DirOutbox is an OutboxStore keeping each device's messages in a log file
+// of its own in the directory. Messages are appended, and the log is only
+// rewritten to drop delivered or expired messages. Writes are synced to
+// disk.
+type DirOutbox string
+
+func (d DirOutbox) path(device string) string {
+	return filepath.Join(string(d), base64.RawURLEncoding.EncodeToString([]byte(device)))
+}
+
+// Load reads the device's log. A record cut short by a crash while it was
+// appended, or claiming more data than the log holds, is dropped from the
+// log with everything after it.
+func (d DirOutbox) Load(device string) ([]OutboxMessage, error) {
+	path := d.path(device)
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []OutboxMessage
+	r := bufio.NewReader(f)
+	var head [outboxHeader]byte
+	var size int64
+	for {
+		_, err := io.ReadFull(r, head[:])
+		if err == io.EOF {
+			return msgs, nil
+		}
+		msg := OutboxMessage{}
+		if err == nil {
+			// Checking the length first keeps a corrupt header from
+			// allocating up to 4 GiB.
+			length := int64(binary.BigEndian.Uint32(head[8:]))
+			if length > info.Size()-size-outboxHeader {
+				return msgs, os.Truncate(path, size)
+			}
+			msg.Data = make([]byte, length)
+			_, err = io.ReadFull(r, msg.Data)
+		}
+		if err == io.ErrUnexpectedEOF {
+			return msgs, os.Truncate(path, size)
+		}
+		if err != nil {
+			return msgs, err
+		}
+		if expires := int64(binary.BigEndian.Uint64(head[:8])); expires != 0 {
+			msg.Expires = time.Unix(0, expires)
+		}
+		msgs = append(msgs, msg)
+		size += int64(outboxHeader + len(msg.Data))
+	}
+}
+
+func (d DirOutbox) Store(device string, msgs []OutboxMessage) error {
+	path := d.path(device)
+	if len(msgs) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(string(d), 0o700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(string(d), ".outbox-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	var record []byte
+	for _, msg := range msgs {
+		record = appendOutboxRecord(record[:0], msg)
+		w.Write(record)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Append adds msg to the end of the device's log. A failed write is cut
+// off again, so the log stays readable.
+func (d DirOutbox) Append(device string, msg OutboxMessage) error {
+	if err := os.MkdirAll(string(d), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.path(device), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		if _, err = f.Write(appendOutboxRecord(nil, msg)); err == nil {
+			err = f.Sync()
+		} else {
+			f.Truncate(info.Size())
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// outboxHeader is the size of a record's expiry and length.
+const outboxHeader = 12
+
+func appendOutboxRecord(dst []byte, msg OutboxMessage) []byte {
+	var expires int64
+	if !msg.Expires.IsZero() {
+		expires = msg.Expires.UnixNano()
+	}
+	dst = binary.BigEndian.AppendUint64(dst, uint64(expires))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msg.Data)))
+	return append(dst, msg.Data...)
+}
+
+// outbox keeps messages for offline devices within its limits. Its mutex
+// orders stored messages before the ones sent once the device is back; it
+// is not held while sending.
+type outbox struct {
+	mu       *sync.Mutex
+	store    OutboxStore
+	ttl      time.Duration
+	maxMsgs  int
+	maxBytes int
+	// sending marks the devices whose stored messages are being sent.
+	// Their messages keep their positions until the sent ones are removed.
+	sending map[string]bool
+}
+
+// add stores data for the device after the live messages already waiting.
+// Expired messages are dropped on the way unless a delivery is under way.
+// The caller must hold o.mu.
+func (o *outbox) add(device string, data []byte) error {
+	stored, err := o.store.Load(device)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	live := make([]OutboxMessage, 0, len(stored))
+	size := len(data)
+	for _, msg := range stored {
+		if msg.Expires.IsZero() || now.Before(msg.Expires) {
+			live = append(live, msg)
+			size += len(msg.Data)
+		}
+	}
+	if o.maxMsgs > 0 && len(live) >= o.maxMsgs || o.maxBytes > 0 && size > o.maxBytes {
+		return ErrOutboxFull
+	}
+
+	msg := OutboxMessage{Data: append([]byte(nil), data...)}
+	if o.ttl > 0 {
+		msg.Expires = now.Add(o.ttl)
+	}
+	if len(live) < len(stored) && !o.sending[device] {
+		return o.store.Store(device, append(live, msg))
+	}
+	if appender, ok := o.store.(OutboxAppender); ok {
+		return appender.Append(device, msg)
+	}
+	return o.store.Store(device, append(stored, msg))
+}
+
+// send sends the live messages of msgs to c, oldest first, and returns how
+// many of msgs are done with, expired ones included.
+func (o *outbox) send(c *Client, msgs []OutboxMessage) (int, error) {
+	now := time.Now()
+	for i, msg := range msgs {
+		if !msg.Expires.IsZero() && !now.Before(msg.Expires) {
+			continue
+		}
+		if err := c.Send(msg.Data); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// remove drops the first n stored messages of the device once they were
+// sent. The caller must hold o.mu.
+func (o *outbox) remove(device string, n int) error {
+	stored, err := o.store.Load(device)
+	if err != nil {
+		return err
+	}
+	return o.store.Store(device, stored[min(n, len(stored)):])
+}
+
+// SendTo sends data like Send to the client bound to the device. When the
+// device is offline, or the send fails, data is kept in the outbox set up
+// with WithOutbox and sent once the device is bound again. Without an
+// outbox ErrClientGone is returned for offline devices.
+func (s *Server) SendTo(device string, data []byte) error {
+	if s.outbox == nil {
+		c := s.ClientByDeviceID(device)
+		if c == nil {
+			return ErrClientGone
+		}
+		return c.Send(data)
+	}
+
+	s.outbox.mu.Lock()
+	c := s.ClientByDeviceID(device)
+	if c == nil {
+		defer s.outbox.mu.Unlock()
+		return s.outbox.add(device, data)
+	}
+	s.outbox.mu.Unlock()
+
+	err := c.Send(data)
+	if err == nil || errors.Is(err, ErrFramingUnsupported) {
+		return err
+	}
+	s.outbox.mu.Lock()
+	defer s.outbox.mu.Unlock()
+	return s.outbox.add(device, data)
+}
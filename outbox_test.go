@@ -0,0 +1,33 @@
+package brts
+
+import (
+	"os"
+	"testing"
+)
+
+func TestDirOutboxCorruptLength(t *testing.T) {
+	d := DirOutbox(t.TempDir())
+	if err := d.Append("dev", OutboxMessage{Data: []byte("kept")}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(d.path("dev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A header claiming 4 GiB of data with only a few bytes behind it.
+	f, err := os.OpenFile(d.path("dev"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\xff\xffdata"))
+	f.Close()
+
+	msgs, err := d.Load("dev")
+	if err != nil || len(msgs) != 1 || string(msgs[0].Data) != "kept" {
+		t.Fatalf("Load = %v, %v; want the record before the corrupt one", msgs, err)
+	}
+	if after, err := os.Stat(d.path("dev")); err != nil || after.Size() != info.Size() {
+		t.Fatalf("log not cut back to the last good record: %v", err)
+	}
+}
@@ -0,0 +1,249 @@
+package brts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var ErrInvalidProxyHeader = errors.New("brts: invalid proxy protocol header")
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+type proxyListener struct {
+	net.Listener
+}
+
+// NewProxyListener wraps l so that every accepted connection must start with
+// a HAProxy PROXY protocol v1 or v2 header. The header is consumed and the
+// connection reports the addresses it carries.
+func NewProxyListener(l net.Listener) net.Listener {
+	return &proxyListener{Listener: l}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), mu: &sync.Mutex{}}, nil
+}
+
+// proxyConn reads the PROXY protocol header once, before the first read, and
+// from then on reports the addresses it carried. remote and local are nil
+// until then.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	once   sync.Once
+	err    error
+
+	mu     *sync.Mutex
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) readHeader() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		remote, local, err := c.parseHeader()
+		c.Conn.SetReadDeadline(time.Time{})
+
+		c.mu.Lock()
+		c.remote, c.local = remote, local
+		c.mu.Unlock()
+		c.err = err
+	})
+	return c.err
+}
+
+// parseHeader consumes the header and returns the addresses it carries,
+// which are nil for a LOCAL or UNKNOWN connection.
+func (c *proxyConn) parseHeader() (remote, local net.Addr, err error) {
+	sig, err := c.reader.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return c.parseV2()
+	}
+	if bytes.HasPrefix(sig, []byte("PROXY")) {
+		return c.parseV1()
+	}
+	return nil, nil, ErrInvalidProxyHeader
+}
+
+func (c *proxyConn) parseV1() (remote, local net.Addr, err error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return nil, nil, ErrInvalidProxyHeader
+		}
+		line = append(line, b)
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	src := net.ParseIP(fields[2])
+	dst := net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	return &net.TCPAddr{IP: src, Port: int(srcPort)}, &net.TCPAddr{IP: dst, Port: int(dstPort)}, nil
+}
+
+func (c *proxyConn) parseV2() (remote, local net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	command := header[12] & 0x0F
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	switch command {
+	case 0x0:
+		return nil, nil, nil
+	case 0x1:
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	case 0x0, 0x3:
+		return nil, nil, nil
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, nil, ErrInvalidProxyHeader
+	}
+
+	src := net.IP(payload[:ipLen])
+	dst := net.IP(payload[ipLen : 2*ipLen])
+	srcPort := int(binary.BigEndian.Uint16(payload[2*ipLen:]))
+	dstPort := int(binary.BigEndian.Uint16(payload[2*ipLen+2:]))
+
+	switch family & 0x0F {
+	case 0x1:
+		return &net.TCPAddr{IP: src, Port: srcPort}, &net.TCPAddr{IP: dst, Port: dstPort}, nil
+	case 0x2:
+		return &net.UDPAddr{IP: src, Port: srcPort}, &net.UDPAddr{IP: dst, Port: dstPort}, nil
+	default:
+		return nil, nil, ErrInvalidProxyHeader
+	}
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if err := c.readHeader(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the header, or the proxy's
+// address until the header has been read and for LOCAL connections. It
+// never reads from the connection.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// expectProxy wraps listener in a proxy listener when the PROXY protocol is
+// enabled for address, the one it was configured with or, for inherited
+// sockets, the one it is bound to.
+func (s *Server) expectProxy(listener net.Listener, address string) net.Listener {
+	if _, ok := listener.(*udpListener); ok {
+		return listener
+	}
+	if s.proxyProto {
+		return NewProxyListener(listener)
+	}
+	for _, proxied := range s.proxyAddrs {
+		if sameAddress(proxied, address) {
+			return NewProxyListener(listener)
+		}
+	}
+	return listener
+}
+
+// sameAddress reports whether two listening addresses name the same socket,
+// treating an empty and an unspecified host alike.
+func sameAddress(a, b string) bool {
+	a = strings.TrimPrefix(strings.TrimPrefix(a, tcpScheme), unixScheme)
+	b = strings.TrimPrefix(strings.TrimPrefix(b, tcpScheme), unixScheme)
+	if a == b {
+		return true
+	}
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil || portA != portB {
+		return false
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	anyA := hostA == "" || ipA != nil && ipA.IsUnspecified()
+	anyB := hostB == "" || ipB != nil && ipB.IsUnspecified()
+	return anyA && anyB || ipA != nil && ipA.Equal(ipB)
+}
+
+func (c *Client) readProxyHeader() error {
+	conn := c.Conn
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.readHeader()
+	}
+	return nil
+}
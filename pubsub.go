@@ -0,0 +1,65 @@
+package brts
+
+import "context"
+
+// Subscribe subscribes the client to a topic, so that what is published on
+// it is sent to the client. Subscriptions end when the client disconnects.
+func (s *Server) Subscribe(c *Client, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[c.id] != c {
+		return ErrClientGone
+	}
+	s.topics.add(c, topic)
+	return nil
+}
+
+// Unsubscribe ends the client's subscription to a topic.
+func (s *Server) Unsubscribe(c *Client, topic string) {
+	s.mu.Lock()
+	s.topics.remove(c, topic)
+	s.mu.Unlock()
+}
+
+// SubscribeFunc calls fn with every payload published on a topic, on the
+// publisher's goroutine. fn must not retain payload. The returned function
+// cancels the subscription.
+func (s *Server) SubscribeFunc(topic string, fn func(topic string, payload []byte)) (cancel func()) {
+	s.mu.Lock()
+	s.nextSub++
+	id := s.nextSub
+	if s.subscribers[topic] == nil {
+		s.subscribers[topic] = make(map[uint64]func(string, []byte))
+	}
+	s.subscribers[topic][id] = fn
+	s.mu.Unlock()
+
+	return func() {
+		s.mu.Lock()
+		delete(s.subscribers[topic], id)
+		if len(s.subscribers[topic]) == 0 {
+			delete(s.subscribers, topic)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Publish hands payload to the topic's internal subscribers and then sends
+// it like Broadcast to the clients subscribed to it.
+func (s *Server) Publish(topic string, payload []byte) error {
+	s.mu.Lock()
+	funcs := make([]func(string, []byte), 0, len(s.subscribers[topic]))
+	for _, fn := range s.subscribers[topic] {
+		funcs = append(funcs, fn)
+	}
+	clients := make([]*Client, 0, len(s.topics.members[topic]))
+	for c := range s.topics.members[topic] {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	for _, fn := range funcs {
+		fn(topic, payload)
+	}
+	return s.broadcast(context.Background(), onlyReady(clients), payload)
+}
@@ -0,0 +1,99 @@
+package brts
+
+import (
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller has
+// to wait before the tokens are actually available.
+func (b *tokenBucket) reserve(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func sleep(d time.Duration, quit <-chan struct{}) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-quit:
+		return false
+	}
+}
+
+// rateBucket returns a bucket holding a second's worth of tokens, or nil
+// for an unlimited rate.
+func rateBucket(perSecond int) *tokenBucket {
+	if perSecond <= 0 {
+		return nil
+	}
+	return newTokenBucket(float64(perSecond), float64(perSecond))
+}
+
+// SetWriteRate limits how many bytes and messages per second are written
+// to the client; zero leaves either unlimited. Writes wait for their turn,
+// queued ones in the client's writer.
+func (c *Client) SetWriteRate(bytesPerSecond, messagesPerSecond int) {
+	c.mu.Lock()
+	c.bytesOut = rateBucket(bytesPerSecond)
+	c.msgsOut = rateBucket(messagesPerSecond)
+	c.mu.Unlock()
+}
+
+// throttle waits until the client's write rate allows size bytes in count
+// messages. It reports false when quit is closed first.
+func (c *Client) throttle(quit <-chan struct{}, size, count int) bool {
+	c.mu.Lock()
+	bytes, msgs := c.bytesOut, c.msgsOut
+	c.mu.Unlock()
+
+	var wait time.Duration
+	if bytes != nil {
+		wait = bytes.reserve(float64(size))
+	}
+	if c.egress != nil {
+		wait = max(wait, c.egress.reserve(float64(size)))
+	}
+	if msgs != nil {
+		wait = max(wait, msgs.reserve(float64(count)))
+	}
+	return sleep(wait, quit)
+}
@@ -0,0 +1,29 @@
+package brts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(10, 2)
+	for i := 0; i < 2; i++ {
+		if d := b.reserve(1); d != 0 {
+			t.Fatalf("reserve %d within the burst waited %v", i, d)
+		}
+	}
+	if d := b.reserve(1); d <= 0 || d > 100*time.Millisecond {
+		t.Fatalf("reserve beyond the burst waited %v, want up to 100ms", d)
+	}
+}
+
+func TestSleepStopsOnQuit(t *testing.T) {
+	quit := make(chan struct{})
+	close(quit)
+	if sleep(time.Hour, quit) {
+		t.Fatal("sleep did not stop when quit was closed")
+	}
+	if !sleep(0, quit) {
+		t.Fatal("sleep without a delay reported quit")
+	}
+}
@@ -0,0 +1,48 @@
+package brts
+
+import (
+	"time"
+)
+
+// handling records when the message whose callback is about to run was
+// received. A client's callbacks run one at a time, so it is the message
+// Reply answers.
+func (c *Client) handling(received time.Time) {
+	c.mu.Lock()
+	c.requestAt = received
+	c.mu.Unlock()
+}
+
+// Reply sends data to the client like Send, in answer to the message being
+// handled, and reports the time since that message was received to
+// OnReply.
+func Reply(c *Client, data []byte) error {
+	c.mu.Lock()
+	received := c.requestAt
+	c.mu.Unlock()
+	return c.reply(received, data)
+}
+
+// Reply sends data to the client the message came from like Send and
+// reports the time since the message was received to OnReply. It must be
+// called before the message is released.
+func (m *Message) Reply(data []byte) error {
+	return m.client.reply(m.received, data)
+}
+
+func (c *Client) reply(received time.Time, data []byte) error {
+	if err := c.Send(data); err != nil {
+		return err
+	}
+	if !received.IsZero() {
+		c.onReply(c, time.Since(received))
+	}
+	return nil
+}
+
+// OnReply is called after every Reply with the time it took to answer the
+// message, for latency metrics. It must be set before the server is
+// started.
+func (s *Server) OnReply(callback func(c *Client, latency time.Duration)) {
+	s.onReply = callback
+}
@@ -0,0 +1,97 @@
+package brts
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrClientGone = errors.New("brts: client is not connected")
+
+// membership tracks which clients joined which room or topic. It is
+// guarded by the server's mutex.
+type membership struct {
+	members map[string]map[*Client]struct{}
+	joined  map[*Client]map[string]struct{}
+}
+
+func newMembership() *membership {
+	return &membership{
+		members: make(map[string]map[*Client]struct{}),
+		joined:  make(map[*Client]map[string]struct{}),
+	}
+}
+
+func (r *membership) add(c *Client, room string) {
+	if r.members[room] == nil {
+		r.members[room] = make(map[*Client]struct{})
+	}
+	r.members[room][c] = struct{}{}
+	if r.joined[c] == nil {
+		r.joined[c] = make(map[string]struct{})
+	}
+	r.joined[c][room] = struct{}{}
+}
+
+func (r *membership) remove(c *Client, room string) {
+	delete(r.members[room], c)
+	if len(r.members[room]) == 0 {
+		delete(r.members, room)
+	}
+	delete(r.joined[c], room)
+	if len(r.joined[c]) == 0 {
+		delete(r.joined, c)
+	}
+}
+
+// removeClient takes c out of everything it joined.
+func (r *membership) removeClient(c *Client) {
+	for room := range r.joined[c] {
+		r.remove(c, room)
+	}
+}
+
+// Join adds the client to a room. Clients leave their rooms when they
+// disconnect.
+func (s *Server) Join(c *Client, room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clients[c.id] != c {
+		return ErrClientGone
+	}
+	s.rooms.add(c, room)
+	return nil
+}
+
+// Leave removes the client from a room.
+func (s *Server) Leave(c *Client, room string) {
+	s.mu.Lock()
+	s.rooms.remove(c, room)
+	s.mu.Unlock()
+}
+
+// RoomMembers returns the clients in a room.
+func (s *Server) RoomMembers(room string) []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	members := make([]*Client, 0, len(s.rooms.members[room]))
+	for c := range s.rooms.members[room] {
+		members = append(members, c)
+	}
+	return members
+}
+
+// ClientRooms returns the rooms the client has joined.
+func (s *Server) ClientRooms(c *Client) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make([]string, 0, len(s.rooms.joined[c]))
+	for room := range s.rooms.joined[c] {
+		names = append(names, room)
+	}
+	return names
+}
+
+// BroadcastToRoom sends data like Broadcast to the clients in a room.
+func (s *Server) BroadcastToRoom(room string, data []byte) error {
+	return s.broadcast(context.Background(), onlyReady(s.RoomMembers(room)), data)
+}
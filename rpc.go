@@ -0,0 +1,163 @@
+package brts
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrRPCDisabled      = errors.New("brts: rpc is not enabled")
+	ErrCallTimeout      = errors.New("brts: call timed out")
+	ErrCallNeedsTimeout = errors.New("brts: call without a worker pool needs a timeout")
+)
+
+// Correlator puts correlation IDs into request frames and finds them in the
+// frames devices answer with.
+type Correlator interface {
+	// Tag appends the request payload, tagged with id, to dst.
+	Tag(dst []byte, id uint32, payload []byte) []byte
+	// Match reports the ID a received frame answers and its payload. Frames
+	// that are not responses are not matched.
+	Match(frame []byte) (id uint32, payload []byte, ok bool)
+}
+
+// PrefixID tags frames with a 4 byte big endian ID before the payload.
+type PrefixID struct{}
+
+func (PrefixID) Tag(dst []byte, id uint32, payload []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, id)
+	return append(dst, payload...)
+}
+
+func (PrefixID) Match(frame []byte) (uint32, []byte, bool) {
+	if len(frame) < 4 {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint32(frame), frame[4:], true
+}
+
+// TextID tags frames with the ID in decimal followed by Sep, such as
+// "17 OK" with a space.
+type TextID struct {
+	Sep byte
+}
+
+func (t TextID) Tag(dst []byte, id uint32, payload []byte) []byte {
+	dst = strconv.AppendUint(dst, uint64(id), 10)
+	dst = append(dst, t.Sep)
+	return append(dst, payload...)
+}
+
+func (t TextID) Match(frame []byte) (uint32, []byte, bool) {
+	i := 0
+	for i < len(frame) && frame[i] >= '0' && frame[i] <= '9' {
+		i++
+	}
+	if i == 0 || i == len(frame) || frame[i] != t.Sep {
+		return 0, nil, false
+	}
+	id, err := strconv.ParseUint(string(frame[:i]), 10, 32)
+	if err != nil {
+		return 0, nil, false
+	}
+	return uint32(id), frame[i+1:], true
+}
+
+type callResult struct {
+	data []byte
+	err  error
+}
+
+// Call sends payload to the client tagged with a new correlation ID and
+// waits for the frame answering it, returning that frame's payload. Zero
+// timeout waits as long as the client stays connected. Answers are taken
+// out of the message stream; frames no call waits for reach the handlers as
+// usual. Without a worker pool, message callbacks run on the client's
+// reader, so a Call made from one only ends by timing out; Call then
+// requires a positive timeout and fails with ErrCallNeedsTimeout otherwise.
+// RPC is enabled with WithRPC.
+func (s *Server) Call(c *Client, payload []byte, timeout time.Duration) ([]byte, error) {
+	if s.rpc == nil {
+		return nil, ErrRPCDisabled
+	}
+	if c.pool == nil && timeout <= 0 {
+		return nil, ErrCallNeedsTimeout
+	}
+
+	result := make(chan callResult, 1)
+	c.mu.Lock()
+	if c.hungUp {
+		c.mu.Unlock()
+		return nil, ErrClientGone
+	}
+	c.nextCall++
+	id := c.nextCall
+	if c.calls == nil {
+		c.calls = make(map[uint32]chan callResult)
+	}
+	c.calls[id] = result
+	c.mu.Unlock()
+	defer c.forgetCall(id)
+
+	if err := c.Send(s.rpc.Tag(nil, id, payload)); err != nil {
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case r := <-result:
+		return r.data, r.err
+	case <-expired:
+		return nil, ErrCallTimeout
+	case <-c.ctx.Done():
+		// Called from the client's own callback, hangUp would only run
+		// after the callback returned.
+		return nil, ErrClientGone
+	}
+}
+
+func (c *Client) forgetCall(id uint32) {
+	c.mu.Lock()
+	delete(c.calls, id)
+	c.mu.Unlock()
+}
+
+// answer hands a received frame to the call it answers, if one waits for
+// it.
+func (c *Client) answer(rpc Correlator, frame []byte) bool {
+	id, payload, ok := rpc.Match(frame)
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	result, ok := c.calls[id]
+	delete(c.calls, id)
+	c.mu.Unlock()
+	if ok {
+		result <- callResult{data: append([]byte(nil), payload...)}
+	}
+	return ok
+}
+
+// hangUp fails the calls and acknowledged sends waiting on a client that
+// disconnected.
+func (c *Client) hangUp() {
+	c.mu.Lock()
+	calls := c.calls
+	c.calls = nil
+	c.hungUp = true
+	c.mu.Unlock()
+	for _, result := range calls {
+		result <- callResult{err: ErrClientGone}
+	}
+	if c.acks != nil {
+		c.acks.close()
+	}
+}
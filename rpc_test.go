@@ -0,0 +1,103 @@
+package brts
+
+import (
+	"testing"
+	"time"
+)
+
+func newRPCServer(t *testing.T) (*Server, chan *Client) {
+	t.Helper()
+	s := newServer(t, WithRPC(TextID{Sep: ' '}), WithWorkers(2, 16))
+	connected := make(chan *Client, 1)
+	s.OnNewConnection(func(c *Client) { connected <- c })
+	return s, connected
+}
+
+type callReturn struct {
+	data []byte
+	err  error
+}
+
+func call(s *Server, c *Client, payload string, timeout time.Duration) <-chan callReturn {
+	result := make(chan callReturn, 1)
+	go func() {
+		data, err := s.Call(c, []byte(payload), timeout)
+		result <- callReturn{data, err}
+	}()
+	return result
+}
+
+func TestCallAnswered(t *testing.T) {
+	s, connected := newRPCServer(t)
+	received := make(chan string, 1)
+	s.OnMessageReceive(func(c *Client, data *[]byte) { received <- string(*data) })
+	start(t, s)
+
+	conn := dial(t, s)
+	c := receive(t, connected)
+	result := call(s, c, "status", 0)
+
+	conn.expect(t, "1 status")
+	conn.send(t, "7 unrelated")
+	conn.send(t, "1 ok")
+
+	r := receive(t, result)
+	if r.err != nil || string(r.data) != "ok\n" {
+		t.Fatalf("Call returned %q, %v; want \"ok\\n\"", r.data, r.err)
+	}
+	if got := receive(t, received); got != "7 unrelated\n" {
+		t.Fatalf("OnMessageReceive got %q, want the frame no call waited for", got)
+	}
+}
+
+func TestCallTimeout(t *testing.T) {
+	s, connected := newRPCServer(t)
+	start(t, s)
+	dial(t, s)
+	c := receive(t, connected)
+
+	if r := receive(t, call(s, c, "status", 20*time.Millisecond)); r.err != ErrCallTimeout {
+		t.Fatalf("Call returned %v, want ErrCallTimeout", r.err)
+	}
+}
+
+func TestCallClientDisconnects(t *testing.T) {
+	s, connected := newRPCServer(t)
+	start(t, s)
+	conn := dial(t, s)
+	c := receive(t, connected)
+	result := call(s, c, "status", 0)
+
+	conn.expect(t, "1 status")
+	conn.Close()
+
+	if r := receive(t, result); r.err != ErrClientGone {
+		t.Fatalf("Call returned %v, want ErrClientGone", r.err)
+	}
+	if r := receive(t, call(s, c, "status", 0)); r.err == nil {
+		t.Fatal("Call to a disconnected client succeeded")
+	}
+}
+
+func TestCallWithoutWorkers(t *testing.T) {
+	s := newServer(t, WithRPC(TextID{Sep: ' '}))
+	result := make(chan error, 1)
+	s.OnMessageReceive(func(c *Client, data *[]byte) {
+		_, err := s.Call(c, []byte("status"), 0)
+		result <- err
+	})
+	start(t, s)
+
+	// Waiting without a timeout would block the client's only reader.
+	dial(t, s).send(t, "hello")
+	if err := receive(t, result); err != ErrCallNeedsTimeout {
+		t.Fatalf("Call returned %v, want ErrCallNeedsTimeout", err)
+	}
+}
+
+func TestCallWithoutRPC(t *testing.T) {
+	s := newServer(t)
+	if _, err := s.Call(&Client{}, nil, 0); err != ErrRPCDisabled {
+		t.Fatalf("Call returned %v, want ErrRPCDisabled", err)
+	}
+}
@@ -0,0 +1,78 @@
+package brts
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var ErrFramingUnsupported = errors.New("brts: framer can not encode outgoing messages")
+
+// encodeFrame frames payload with framer for sending.
+func encodeFrame(framer Framer, dst, payload []byte) ([]byte, error) {
+	encoder, ok := framer.(FrameEncoder)
+	if !ok {
+		return dst, ErrFramingUnsupported
+	}
+	return encoder.EncodeFrame(dst, payload)
+}
+
+// sendFramer is the framer the client's messages are read with, or nil for
+// datagram connections, which are not framed.
+func (c *Client) sendFramer() Framer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case isDatagram(c.Conn):
+		return nil
+	case c.framer != nil:
+		return c.framer
+	default:
+		return c.framing
+	}
+}
+
+func isDatagram(conn net.Conn) bool {
+	_, ok := conn.(*udpConn)
+	return ok
+}
+
+// Send frames data the way the client's messages are read, appending the
+// delimiter or prepending the length, and writes it in one piece.
+// Datagrams are sent as they are.
+func (c *Client) Send(data []byte) error {
+	return c.SendContext(context.Background(), data)
+}
+
+// SendContext sends data like Send, giving up when ctx ends while waiting
+// for room in the write queue or for the socket. A send cut off halfway
+// leaves a partial frame behind, after which the connection is best closed.
+func (c *Client) SendContext(ctx context.Context, data []byte) error {
+	return c.send(ctx, data, PriorityNormal)
+}
+
+// SendPriority sends data like Send, queued with the given priority when
+// the client has a write queue.
+func (c *Client) SendPriority(data []byte, priority Priority) error {
+	return c.send(context.Background(), data, priority)
+}
+
+func (c *Client) send(ctx context.Context, data []byte, priority Priority) error {
+	framer := c.sendFramer()
+	if framer == nil {
+		_, err := c.write(ctx, data, priority)
+		return err
+	}
+
+	frame, err := encodeFrame(framer, nil, data)
+	if err != nil {
+		return err
+	}
+	_, err = c.write(ctx, frame, priority)
+	return err
+}
+
+// SendLine sends line framed like Send.
+func (c *Client) SendLine(line string) error {
+	return c.Send([]byte(line))
+}
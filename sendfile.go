@@ -0,0 +1,88 @@
+package brts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+)
+
+// sendFileChunk is how much of a file is sent per write deadline and rate
+// limit reservation.
+const sendFileChunk = 1 << 20
+
+var ErrNotStream = errors.New("brts: not a stream connection")
+
+// SendFile writes length bytes of the file at path, starting at offset, to
+// the client as they are, without framing. Zero length sends the rest of the
+// file. Plain TCP connections use sendfile, so the data is not copied
+// through user space. Queued messages are written first, and the write
+// timeout applies to each megabyte sent.
+func (c *Client) SendFile(path string, offset, length int64) (int64, error) {
+	c.mu.Lock()
+	conn := c.Conn
+	timeout := c.writeTimeout
+	c.mu.Unlock()
+	if isDatagram(conn) {
+		return 0, ErrNotStream
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	if length <= 0 {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		length = info.Size() - offset
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	if err := c.Flush(context.Background()); err != nil {
+		return 0, err
+	}
+	conn, _, err = c.beginWrite(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	w := writerOf(conn)
+
+	var sent int64
+	for sent < length && err == nil {
+		chunk := min(length-sent, sendFileChunk)
+		c.throttle(nil, int(chunk), 0)
+		conn.SetWriteDeadline(deadline(timeout))
+		var n int64
+		n, err = io.CopyN(w, f, chunk)
+		sent += n
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	err = c.endWrite(context.Background(), nil, sent, 0, err)
+	if err != nil {
+		c.writeFailed(err)
+	}
+	return sent, err
+}
+
+// writerOf looks through the wrappers that only replay read data, so
+// writes reach the socket itself.
+func writerOf(conn net.Conn) net.Conn {
+	for {
+		switch c := conn.(type) {
+		case *sniffConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return conn
+		}
+	}
+}
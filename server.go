@@ -2,227 +2,1657 @@ package brts
 
 import (
 	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	DefaultTimeout      time.Duration = 10 * time.Minute
-	DefaultMessageDelim byte          = '\r'
+	DefaultTimeout          time.Duration = 10 * time.Minute
+	DefaultBroadcastTimeout time.Duration = 10 * time.Second
+	DefaultMessageDelim     byte          = '\r'
+)
+
+const (
+	tcpScheme  = "tcp://"
+	unixScheme = "unix://"
+)
+
+const (
+	minAcceptDelay     = 5 * time.Millisecond
+	maxAcceptDelay     = time.Second
+	rejectWriteTimeout = time.Second
+	goAwayWriteTimeout = time.Second
+)
+
+var (
+	ErrServerClosed   = errors.New("brts: server closed")
+	ErrTooManyClients = errors.New("brts: too many clients")
 )
 
 type Server struct {
 	idleTimeout  time.Duration
-	address      string
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	frameTimeout time.Duration
+	minReadRate  int
+	rateInterval time.Duration
+	addresses    []string
 	waitGroup    *sync.WaitGroup
 	mu           *sync.Mutex
-	clients      map[*Client]struct{}
+	clients      map[uint64]*Client
+	evicting     map[uint64]struct{}
+	rooms        *membership
+	topics       *membership
+	devices      map[string]*Client
+	lastID       atomic.Uint64
+	subscribers  map[string]map[uint64]func(topic string, payload []byte)
+	nextSub      uint64
 	signalCh     chan os.Signal
+	handleSignal bool
 	messageDelim byte
+	framer       Framer
+	decoder      Decoder
+	encoder      Encoder
+	middleware   []Middleware
+	maxClients   int
+	evictIdle    bool
+	evictAfter   time.Duration
+	authTimeout  time.Duration
+	retention    time.Duration
+	sessions     map[string]*session
+	maxSessions  int
+	sessionBytes int
+	helloTimeout time.Duration
+	maxMsgSize   int
+	truncateMsgs bool
+	workers      int
+	highWater    int
+	lowWater     int
+	batchSize    int
+	batchDelay   time.Duration
+	pool         *workerPool
+	engine       Engine
+	events       *eventEngine
+	copyPayload  bool
+	readBufSize  int
+	maxReadSize  int
+	logger       Logger
+	tlsConfig    *tls.Config
+	acmeManaged  bool
+	clientAuth   tls.ClientAuthType
+	clientCAs    *x509.CertPool
+	socketMode   os.FileMode
+	proxyProto   bool
+	proxyAddrs   []string
+	detectTLS    bool
+	reusePort    int
+	listenConfig *net.ListenConfig
+	acceptRate   *tokenBucket
+	upgradeOnSig bool
+	upgradeReady *os.File
+	busyMessage  []byte
+	goAwayMsg    []byte
+	kickMessage  func(reason string) []byte
+	nackMessage  []byte
+	writeQueue   int
+	queuePolicy  QueuePolicy
+	coalesceSize int
+	flushDelay   time.Duration
+	writeBytes   int
+	writeMsgs    int
+	ingress      *tokenBucket
+	egress       *tokenBucket
+	rpc          Correlator
+	ackFrame     []byte
+	ackRetries   int
+	outbox       *outbox
+	budget       clientBudget
+	compressions []string
+	inflate      []string
+	inflateRatio int
+	ipLimits     *ipLimits
+	filter       *ipFilter
+	err          error
+	listeners    []net.Listener
+	addrs        []*net.TCPAddr
+	prepared     bool
+	quit         chan struct{}
+	quitOnce     *sync.Once
+	draining     bool
+	goingAway    bool
+	done         chan struct{}
+	serveErr     error
 
 	onServerStarted  func(addr *net.TCPAddr)
 	onServerStopped  func()
 	onNewConnection  func(c *Client)
 	onConnectionLost func(c *Client)
 	onMessageReceive func(c *Client, data *[]byte)
+	onMessage        func(c *Client, m *Message)
+	onMessageBatch   func(c *Client, msgs [][]byte)
+
+	onConnectionRejected func(conn net.Conn, reason error)
+	onDraining           func()
+	onMessageError       func(c *Client, err error)
+	onWriteError         func(c *Client, err error)
+	onError              func(c *Client, err error)
+	onReply              func(c *Client, latency time.Duration)
+	onAckFailure         func(c *Client, data []byte)
+	onOverBudget         func(c *Client, err error)
+	onEviction           func(c *Client)
+	onIdleTimeout        func(c *Client)
+	onAuthenticated      func(c *Client)
+	onHandshake          func(c *Client, frame []byte) error
+	onDuplicate          func(device string, old, replacement *Client)
+	onInvalidFrame       func(c *Client, frame []byte, err error)
+	onDecoded            func(c *Client, msg any)
+	onDecodeError        func(c *Client, data []byte, err error)
+
+	serverNameHandlers map[string]Handlers
+	protocolHandlers   map[string]Handlers
+	trafficRoutes      map[Traffic]Handlers
+	matchRoutes        []*matchRoute
+}
+
+type Handlers struct {
+	OnNewConnection  func(c *Client)
+	OnConnectionLost func(c *Client)
+	OnMessageReceive func(c *Client, data *[]byte)
+	OnMessage        func(c *Client, m *Message)
 }
 
 type Client struct {
 	Conn net.Conn
 
-	idleTimeout time.Duration
-	closeCh     chan struct{}
-}
-
-type accepted struct {
-	conn net.Conn
-	err  error
+	id           uint64
+	idleTimeout  time.Duration
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	receiving    bool
+	pace         *pacer
+	compressions []string
+	compressing  *compressedConn
+	reader       *bufio.Reader
+	encoder      Encoder
+	interrupted  bool
+	lastRead     time.Time
+	lastWrite    time.Time
+	connected    time.Time
+	stats        ClientStats
+	mu           *sync.Mutex
+	writeLock    chan struct{}
+	onWriteErr   func(c *Client, err error)
+	onErr        func(c *Client, err error)
+	onReply      func(c *Client, latency time.Duration)
+	requestAt    time.Time
+	calls        map[uint32]chan callResult
+	nextCall     uint32
+	hungUp       bool
+	acks         *acker
+	device       string
+	values       map[string]any
+	token        string
+	tags         map[string]struct{}
+	ctx          context.Context
+	cancel       context.CancelFunc
+	budget       clientBudget
+	inbound      int
+	goroutines   int
+	exceeded     bool
+	onExceeded   func(c *Client, err error)
+	reason       string
+	onIdle       func(c *Client)
+	extended     bool
+	auth         AuthState
+	authTimer    *time.Timer
+	onAuthed     func(c *Client)
+	bytesOut     *tokenBucket
+	msgsOut      *tokenBucket
+	ingress      *tokenBucket
+	egress       *tokenBucket
+	queue        *writeQueue
+	handlers     Handlers
+	framer       Framer
+	framing      Framer
+	ip           net.IP
+	admitted     bool
+	ready        bool
+	traffic      Traffic
+	matched      *matchRoute
+	pool         *workerPool
+	tasks        []func()
+	scheduled    bool
+	paused       bool
+	drained      *sync.Cond
+	detach       func()
+	resume       func()
+	pending      *sync.WaitGroup
 }
 
-func Create(address string) *Server {
+func Create(address string, opts ...Option) *Server {
 	server := &Server{
 		idleTimeout:  DefaultTimeout,
-		address:      address,
+		addresses:    []string{address},
 		waitGroup:    &sync.WaitGroup{},
 		mu:           &sync.Mutex{},
-		clients:      make(map[*Client]struct{}),
-		signalCh:     make(chan os.Signal),
+		clients:      make(map[uint64]*Client),
+		evicting:     make(map[uint64]struct{}),
+		rooms:        newMembership(),
+		topics:       newMembership(),
+		devices:      make(map[string]*Client),
+		sessions:     make(map[string]*session),
+		maxSessions:  DefaultMaxSessions,
+		sessionBytes: DefaultSessionUnsent,
+		subscribers:  make(map[string]map[uint64]func(topic string, payload []byte)),
+		signalCh:     make(chan os.Signal, 1),
 		messageDelim: DefaultMessageDelim,
+		helloTimeout: DefaultHandshakeTimeout,
+		copyPayload:  true,
+		logger:       stdLogger{},
+		filter:       &ipFilter{},
+		quit:         make(chan struct{}),
+		quitOnce:     &sync.Once{},
+		done:         make(chan struct{}),
 
 		onServerStarted:  func(addr *net.TCPAddr) {},
 		onServerStopped:  func() {},
 		onNewConnection:  func(c *Client) {},
 		onConnectionLost: func(c *Client) {},
 		onMessageReceive: func(c *Client, data *[]byte) {},
+
+		onConnectionRejected: func(conn net.Conn, reason error) {},
+		onDraining:           func() {},
+		onMessageError:       func(c *Client, err error) {},
+		onWriteError:         func(c *Client, err error) {},
+		onError:              func(c *Client, err error) {},
+		onReply:              func(c *Client, latency time.Duration) {},
+		onAckFailure:         func(c *Client, data []byte) {},
+		onOverBudget:         func(c *Client, err error) {},
+		onEviction:           func(c *Client) {},
+		onIdleTimeout:        func(c *Client) {},
+		onDuplicate:          func(device string, old, replacement *Client) {},
+		onAuthenticated:      func(c *Client) {},
+		onInvalidFrame:       func(c *Client, frame []byte, err error) {},
+		onDecodeError:        func(c *Client, data []byte, err error) {},
+
+		serverNameHandlers: make(map[string]Handlers),
+		protocolHandlers:   make(map[string]Handlers),
+		trafficRoutes:      make(map[Traffic]Handlers),
+	}
+
+	for _, opt := range opts {
+		if err := opt(server); err != nil {
+			server.err = err
+			break
+		}
 	}
 	return server
 }
 
-func newClient(conn net.Conn, timeout time.Duration) *Client {
+func newClient(conn net.Conn, s *Server) *Client {
 	client := &Client{
-		Conn:        conn,
-		idleTimeout: timeout,
-		closeCh:     make(chan struct{}),
+		Conn:         conn,
+		id:           s.lastID.Add(1),
+		connected:    time.Now(),
+		idleTimeout:  s.idleTimeout,
+		readTimeout:  s.readTimeout,
+		writeTimeout: s.writeTimeout,
+		pace:         s.newPacer(),
+		compressions: s.compressions,
+		encoder:      s.encoder,
+		onWriteErr:   s.onWriteError,
+		onErr:        s.onError,
+		onReply:      s.onReply,
+		acks:         s.newAcker(),
+		budget:       s.budget,
+		onExceeded:   s.onOverBudget,
+		onIdle:       s.onIdleTimeout,
+		onAuthed:     s.onAuthenticated,
+		bytesOut:     rateBucket(s.writeBytes),
+		msgsOut:      rateBucket(s.writeMsgs),
+		ingress:      s.ingress,
+		egress:       s.egress,
+		framing:      s.defaultFramer(),
+		mu:           &sync.Mutex{},
+		writeLock:    make(chan struct{}, 1),
+		pending:      &sync.WaitGroup{},
+	}
+	client.ctx, client.cancel = context.WithCancel(context.Background())
+	if s.retention > 0 {
+		client.token = rand.Text()
 	}
 	return client
 }
 
 func (s *Server) Start() error {
-	addr, _ := net.ResolveTCPAddr("tcp", s.address)
-	listener, err := net.ListenTCP("tcp", addr)
+	return s.StartContext(context.Background())
+}
+
+func (s *Server) StartContext(ctx context.Context) error {
+	listeners, err := s.bind()
+	if err != nil {
+		return err
+	}
+	return s.serve(ctx, listeners)
+}
+
+func (s *Server) StartAsync() error {
+	listeners, err := s.bind()
 	if err != nil {
 		return err
 	}
+	s.prepare(listeners)
+	go s.serve(context.Background(), listeners)
+	return nil
+}
+
+func (s *Server) bind() ([]net.Listener, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	listeners, err := s.inheritedListeners()
+	if err != nil {
+		return nil, err
+	}
+	if listeners == nil {
+		listeners, err = s.bindAddresses()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for i, listener := range listeners {
+			listeners[i] = s.expectProxy(listener, listener.Addr().String())
+		}
+	}
 
-	go s.onServerStarted(addr)
+	for i, listener := range listeners {
+		listeners[i] = s.wrapListener(listener)
+	}
+	return listeners, nil
+}
 
+func (s *Server) bindAddresses() ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(s.addresses))
+	for _, address := range s.addresses {
+		count := 1
+		if s.reusePort > 1 && isTCPAddress(address) {
+			count = s.reusePort
+		}
+
+		configured := address
+		for i := 0; i < count; i++ {
+			listener, err := s.listenAddress(address)
+			if err != nil {
+				for _, l := range listeners {
+					l.Close()
+				}
+				return nil, err
+			}
+			listeners = append(listeners, s.expectProxy(listener, configured))
+
+			// bind the remaining sockets to the port actually assigned
+			// to the first one, in case an ephemeral port was requested
+			address = listener.Addr().String()
+		}
+	}
+	return listeners, nil
+}
+
+func isTCPAddress(address string) bool {
+	return !strings.HasPrefix(address, udpScheme) && !strings.HasPrefix(address, unixScheme)
+}
+
+func (s *Server) listenAddress(address string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(address, udpScheme):
+		return listenUDP(s.netListenConfig(), strings.TrimPrefix(address, udpScheme))
+	case strings.HasPrefix(address, unixScheme):
+		return s.listenUnix(strings.TrimPrefix(address, unixScheme))
+	default:
+		return s.listenTCP(strings.TrimPrefix(address, tcpScheme))
+	}
+}
+
+func (s *Server) wrapListener(listener net.Listener) net.Listener {
+	if _, ok := listener.(*udpListener); ok {
+		return listener
+	}
+	if s.tlsConfig != nil && !s.detectTLS {
+		listener = &tlsListener{Listener: listener, config: s.serverTLSConfig()}
+	}
+	return listener
+}
+
+func (s *Server) netListenConfig() *net.ListenConfig {
+	lc := &net.ListenConfig{}
+	if s.listenConfig != nil {
+		*lc = *s.listenConfig
+	}
+	return lc
+}
+
+func chainControl(first, second func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if first == nil {
+		return second
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return second(network, address, c)
+	}
+}
+
+func (s *Server) listenTCP(address string) (net.Listener, error) {
+	lc := s.netListenConfig()
+	if s.reusePort > 0 {
+		lc.Control = chainControl(lc.Control, reusePortControl)
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := s.netListenConfig().Listen(context.Background(), "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if ul, ok := listener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(true)
+	}
+
+	if s.socketMode != 0 {
+		if err := os.Chmod(path, s.socketMode); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func (s *Server) Serve(listener net.Listener) error {
+	return s.ServeContext(context.Background(), listener)
+}
+
+func (s *Server) ServeContext(ctx context.Context, listener net.Listener) error {
+	return s.serve(ctx, []net.Listener{listener})
+}
+
+func (s *Server) serve(ctx context.Context, listeners []net.Listener) (err error) {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.prepare(listeners)
+
+	accepting := &sync.WaitGroup{}
 	defer func() {
-		listener.Close()
+		s.closeListeners()
+		accepting.Wait()
+		s.waitGroup.Wait()
+		s.stopEngine()
+		s.stopWorkers()
 		s.onServerStopped()
+
+		s.mu.Lock()
+		s.serveErr = err
+		s.prepared = false
+		close(s.done)
+		s.mu.Unlock()
 	}()
 
-	signal.Notify(s.signalCh, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGINT)
+	if s.handleSignal {
+		signal.Notify(s.signalCh, os.Interrupt, os.Kill, syscall.SIGTERM, syscall.SIGINT)
+		defer signal.Stop(s.signalCh)
+	}
 
-	c := make(chan accepted, 1)
-	for {
-		go func() {
-			conn, err := listener.Accept()
-			c <- accepted{conn, err}
-		}()
+	var upgradeCh chan os.Signal
+	if s.upgradeOnSig {
+		if signals := upgradeSignals(); len(signals) > 0 {
+			upgradeCh = make(chan os.Signal, 1)
+			signal.Notify(upgradeCh, signals...)
+			defer signal.Stop(upgradeCh)
+		}
+	}
+
+	quit := s.quit
+	acceptErr := make(chan error, len(listeners))
+	beats := make([]acceptBeat, len(listeners))
+	for i, listener := range listeners {
+		accepting.Add(1)
+		go func(listener net.Listener, beat *acceptBeat) {
+			defer accepting.Done()
+			if err := s.acceptLoop(listener, quit, beat); err != nil {
+				acceptErr <- err
+			}
+		}(listener, &beats[i])
+	}
+	s.signalUpgradeReady()
+	s.notify("READY=1")
+	go s.onServerStarted(s.Addr())
+
+	var watchdog <-chan time.Time
+	interval := watchdogInterval()
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
 
+	for {
 		select {
-		case accept := <-c:
-			if accept.err != nil {
-				log.Printf("error accepting connection %v", err)
+		case <-quit:
+			return nil
+
+		case err := <-acceptErr:
+			s.logger.Printf("accept failed, shutting down server...")
+			s.stop()
+			return err
+
+		case <-watchdog:
+			// Let systemd restart the process if an accept loop hangs.
+			if stalled(beats, interval) {
+				s.logger.Printf("accept loop stalled, skipping watchdog notification")
 				continue
 			}
-			client := newClient(accept.conn, s.idleTimeout)
-			s.waitGroup.Add(1)
-			go s.listen(client)
+			s.notify("WATCHDOG=1")
+
+		case <-upgradeCh:
+			s.logger.Printf("upgrading server...")
+			go func() {
+				if err := s.Upgrade(); err != nil {
+					s.logger.Printf("upgrade failed: %v", err)
+				}
+			}()
 
 		case <-s.signalCh:
-			log.Println("shutting down server...")
-			listener.Close()
-			s.closeConnections()
-			s.waitGroup.Wait()
+			s.logger.Printf("shutting down server...")
+			s.stop()
+			return nil
+
+		case <-ctx.Done():
+			s.logger.Printf("context done, shutting down server...")
+			s.stop()
 			return nil
 		}
 	}
 }
 
-func (s *Server) listen(c *Client) {
-	s.addClient(c)
-	s.onNewConnection(c)
+// notify reports a state change to systemd, if it supervises the process.
+func (s *Server) notify(state string) {
+	if err := sdNotify(state); err != nil {
+		s.logger.Printf("systemd notify %s: %v", state, err)
+	}
+}
 
-	defer func() {
-		c.Conn.Close()
-		s.waitGroup.Done()
-		s.removeClient(c)
-		s.onConnectionLost(c)
+// acceptLoop accepts connections until the server stops. It returns the
+// Accept error that made it give up, or nil on shutdown.
+func (s *Server) acceptLoop(listener net.Listener, quit chan struct{}, beat *acceptBeat) error {
+	defer beat.park()
+	var delay time.Duration
+	for {
+		beat.park()
+		if s.acceptRate != nil && !sleep(s.acceptRate.reserve(1), quit) {
+			return nil
+		}
+
+		conn, err := listener.Accept()
+		beat.stamp()
+		if err != nil {
+			select {
+			case <-quit:
+				return nil
+			default:
+			}
+			if s.isDraining() || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			if !temporaryAcceptError(err) {
+				s.logger.Printf("error accepting connection %v, stop accepting on %v", err, listener.Addr())
+				err = &AcceptError{Addr: listener.Addr(), Err: err}
+				s.onError(nil, err)
+				return err
+			}
+
+			if delay == 0 {
+				delay = minAcceptDelay
+			} else {
+				delay *= 2
+			}
+			if delay > maxAcceptDelay {
+				delay = maxAcceptDelay
+			}
+			s.logger.Printf("error accepting connection %v, retrying in %v", err, delay)
+			s.onError(nil, &AcceptError{Addr: listener.Addr(), Temporary: true, Err: err})
+			beat.park()
+			if !sleep(delay, quit) {
+				return nil
+			}
+			continue
+		}
+		delay = 0
+
+		client := newClient(conn, s)
+		if err := s.addClient(client); err != nil {
+			if err == ErrServerClosed {
+				conn.Close()
+				return nil
+			}
+			go s.reject(conn, err)
+			continue
+		}
+		go s.listen(client)
+	}
+}
+
+// acceptBeat is an accept loop's heartbeat: when it last returned from
+// Accept, or zero while it waits in Accept or a deliberate delay.
+type acceptBeat struct {
+	busySince atomic.Int64
+}
+
+func (b *acceptBeat) park() {
+	b.busySince.Store(0)
+}
+
+func (b *acceptBeat) stamp() {
+	b.busySince.Store(time.Now().UnixNano())
+}
+
+// stalled reports whether an accept loop has been busy with one connection
+// for longer than timeout.
+func stalled(beats []acceptBeat, timeout time.Duration) bool {
+	for i := range beats {
+		since := beats[i].busySince.Load()
+		if since != 0 && time.Since(time.Unix(0, since)) > timeout {
+			return true
+		}
+	}
+	return false
+}
+
+// temporaryAcceptError reports whether Accept may succeed when retried: the
+// process or system ran out of descriptors or buffers, or a pending
+// connection was reset before it was accepted.
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) ||
+		errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.ENOMEM) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.ECONNRESET)
+}
+
+func (s *Server) reject(conn net.Conn, reason error) {
+	s.logger.Printf("rejecting connection from %v: %v", conn.RemoteAddr(), reason)
+	if len(s.busyMessage) > 0 && isLimitError(reason) {
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		conn.Write(s.busyMessage)
+	}
+	conn.Close()
+	s.onConnectionRejected(conn, reason)
+}
+
+func (s *Server) stop() {
+	s.closeListeners()
+	s.goAway()
+	s.closeQuit()
+	s.closeConnections()
+}
+
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	done, running := s.done, s.prepared
+	s.mu.Unlock()
+
+	var errs errorList
+	errs = append(errs, s.closeListeners()...)
+
+	s.goAway()
+	s.closeQuit()
+
+	// Wait for the clients and, if the server is running, for serve to
+	// finish its cleanup.
+	finished := make(chan struct{})
+	go func() {
+		s.waitGroup.Wait()
+		if running {
+			<-done
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+		errs = append(errs, s.closeConnections()...)
+	}
+	return errs.err()
+}
+
+func (s *Server) prepare(listeners []net.Listener) {
+	addrs := make([]*net.TCPAddr, 0, len(listeners))
+	for _, listener := range listeners {
+		if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		s.quit = make(chan struct{})
+		s.quitOnce = &sync.Once{}
+		s.done = make(chan struct{})
+		s.serveErr = nil
+		s.draining = false
+		s.goingAway = false
+		for len(s.signalCh) > 0 {
+			<-s.signalCh
+		}
+	default:
+	}
+	if s.prepared {
+		// StartAsync already prepared this run.
+		return
+	}
+	s.prepared = true
+
+	workers, highWater, lowWater := s.workers, s.highWater, s.lowWater
+	if s.engine != EngineGoroutine {
+		// Event loops must not run callbacks themselves.
+		if workers == 0 {
+			workers = runtime.GOMAXPROCS(0)
+		}
+		if highWater == 0 {
+			highWater, lowWater = defaultEngineQueue, defaultEngineQueue/2
+		}
+
+		events, err := newEventEngine(s, s.engine, runtime.GOMAXPROCS(0))
+		if err != nil {
+			s.logger.Printf("event engine unavailable, using goroutines: %v", err)
+		}
+		s.events = events
+	}
+	if workers > 0 {
+		s.pool = newWorkerPool(workers, highWater, lowWater)
+	}
+	s.listeners = listeners
+	s.addrs = addrs
+}
+
+func (s *Server) Addr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.addrs) == 0 {
+		return nil
+	}
+	return s.addrs[0]
+}
+
+func (s *Server) Addrs() []*net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]*net.TCPAddr, len(s.addrs))
+	copy(addrs, s.addrs)
+	return addrs
+}
+
+func (s *Server) Wait() error {
+	<-s.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.serveErr
+}
+
+func (s *Server) Done() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done
+}
+
+// Drain stops accepting new connections but keeps serving the connected
+// clients. The server stops once the last client has disconnected.
+func (s *Server) Drain() error {
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return nil
+	}
+	s.draining = true
+	quit, quitOnce := s.quit, s.quitOnce
+	s.mu.Unlock()
+
+	errs := errorList(s.closeListeners())
+	s.goAway()
+
+	go func() {
+		s.waitGroup.Wait()
+		quitOnce.Do(func() {
+			close(quit)
+		})
 	}()
+	return errs.err()
+}
+
+// goAway fires OnDraining and sends the go-away message to every connected
+// client, once per run.
+func (s *Server) goAway() {
+	s.mu.Lock()
+	if s.goingAway {
+		s.mu.Unlock()
+		return
+	}
+	s.goingAway = true
+	s.mu.Unlock()
 
-	c.updateDeadline()
+	s.notify("STOPPING=1")
+	s.onDraining()
+	if len(s.goAwayMsg) == 0 {
+		return
+	}
 
-	type receiveData struct {
-		data *[]byte
-		err  error
+	s.mu.Lock()
+	clients := make([]*Client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
 	}
+	s.mu.Unlock()
 
-	timeout := time.After(c.idleTimeout)
-	scrCh := make(chan receiveData)
-	reader := bufio.NewReader(c)
+	wg := &sync.WaitGroup{}
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			c.Conn.SetWriteDeadline(time.Now().Add(goAwayWriteTimeout))
+			c.Conn.Write(s.goAwayMsg)
+			// Writes still queued for the client must not inherit it.
+			c.Conn.SetWriteDeadline(time.Time{})
+		}(c)
+	}
+	wg.Wait()
+}
 
-	for {
-		go func(scanCh chan receiveData) {
-			data, err := reader.ReadBytes(s.messageDelim)
-			if err != nil {
-				if err == io.EOF {
-					c.closeCh <- struct{}{}
-					return
-				}
-				fmt.Printf("Error %s: %v\n", c.Conn.RemoteAddr(), err)
-				c.closeCh <- struct{}{}
-			} else {
-				scanCh <- receiveData{&data, err}
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+func (s *Server) closeQuit() {
+	s.mu.Lock()
+	s.quitOnce.Do(func() {
+		close(s.quit)
+		for _, c := range s.clients {
+			c.interrupt()
+		}
+	})
+	s.mu.Unlock()
+}
+
+func (s *Server) quitting() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Server) closeListeners() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, listener := range s.listeners {
+		if err := listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.listeners = nil
+	return errs
+}
+
+func (s *Server) listen(c *Client) {
+	if err := c.readProxyHeader(); err != nil {
+		s.handshakeFailed(c, err)
+		return
+	}
+	if err := s.admitLate(c); err != nil {
+		s.abort(c)
+		s.reject(c.Conn, err)
+		return
+	}
+	s.sniff(c)
+	if err := c.handshake(); err != nil {
+		s.handshakeFailed(c, err)
+		return
+	}
+	if err := s.awaitHandshake(c); err != nil {
+		if isTimeout(err) {
+			s.onError(c, &TimeoutError{Err: err})
+		}
+		s.abort(c)
+		s.reject(c.Conn, err)
+		return
+	}
+
+	c.handlers = s.handlersFor(c)
+	s.startWriter(c)
+	s.startAuthTimer(c)
+	c.mu.Lock()
+	c.ready = true
+	c.mu.Unlock()
+	c.handlers.OnNewConnection(c)
+
+	// Decompression needs the stream and sniffed connections hold peeked
+	// bytes, so those clients keep their goroutine.
+	if events := s.eventEngine(); events != nil && len(s.inflate) == 0 && events.register(c) {
+		return
+	}
+	defer s.finish(c)
+
+	batch := s.newBatcher(c)
+	defer batch.close()
+
+	// The read buffer can only be reused when callbacks run inline and
+	// messages are not held back for a batch.
+	reuse := !s.copyPayload && c.pool == nil && batch == nil
+
+	readMessage := c.readDatagram
+	if _, ok := c.Conn.(*udpConn); !ok {
+		buffered := getReader(c, s.readBufSize)
+		defer putReader(buffered)
+		raw := buffered
+		c.mu.Lock()
+		c.reader = raw
+		c.mu.Unlock()
+		defer func() {
+			c.mu.Lock()
+			c.reader = nil
+			c.mu.Unlock()
+		}()
+		if inflated := s.decompress(c, buffered); inflated != nil {
+			defer putReader(inflated)
+			buffered = inflated
+		}
+
+		reader := s.limitReader(buffered)
+		framer := s.framerFor(c)
+		readMessage = func(dst []byte) ([]byte, error) {
+			if fr, ok := reader.(*frameReader); ok {
+				fr.reset()
 			}
-		}(scrCh)
+			c.startCompression(raw)
+			c.startMessage(buffered.Buffered() > 0)
+			return appendFrame(framer, dst, reader, reuse)
+		}
+	}
 
-		select {
-		case rcv := <-scrCh:
-			timeout = time.After(c.idleTimeout)
-			s.onMessageReceive(c, rcv.data)
+	var scratch []byte
+	for {
+		if s.quitting() {
+			return
+		}
+
+		var m *Message
+		var dst []byte
+		switch {
+		case c.handlers.OnMessage != nil && batch == nil:
+			m = newMessage()
+			dst = m.Data
+		case reuse:
+			dst = scratch[:0]
+		}
 
-		case <-timeout:
-			log.Printf("timeout: %v\n", c.Conn.RemoteAddr())
+		data, err := readMessage(dst)
+		if m == nil && reuse {
+			scratch = data
+		}
+		var invalid *InvalidFrameError
+		if errors.As(err, &invalid) {
+			s.invalidFrame(c, invalid)
+			m.release()
+			continue
+		}
+		if err != nil {
+			m.release()
+			s.readFailed(c, err)
 			return
+		}
+		s.deliver(c, data, m, batch)
+	}
+}
 
-		case <-c.closeCh:
+// deliver hands a received message to the client's callbacks: to OnMessage
+// when m is set, to the batch when there is one and to OnMessageReceive
+// otherwise. Messages over the maximum size are dropped or truncated first.
+func (s *Server) deliver(c *Client, data []byte, m *Message, batch *batcher) {
+	if s.maxMsgSize > 0 && len(data) > s.maxMsgSize {
+		s.onMessageError(c, ErrMessageTooLarge)
+		s.onError(c, &FramingError{Err: ErrMessageTooLarge})
+		if !s.truncateMsgs {
+			m.release()
 			return
 		}
+		data = data[:s.maxMsgSize]
+	}
+
+	c.mu.Lock()
+	c.stats.MessagesIn++
+	c.mu.Unlock()
+
+	if s.rpc != nil && c.answer(s.rpc, data) || c.acks != nil && c.takeAck(data) {
+		m.release()
+		return
+	}
+
+	if batch == nil && !c.charge(len(data)) {
+		m.release()
+		return
+	}
+
+	received := time.Now()
+	switch {
+	case m != nil:
+		handler := c.handlers.OnMessage
+		m.client = c
+		m.received = received
+		c.dispatch(func() {
+			c.charge(-len(data))
+			c.handling(received)
+			s.handle(c, data, func(data []byte) {
+				m.Data = data
+				handler(c, m)
+			})
+			m.Release()
+		})
+	case batch != nil:
+		batch.add(data)
+	case s.decoder != nil && s.onDecoded != nil:
+		c.dispatch(func() {
+			c.charge(-len(data))
+			c.handling(received)
+			s.handle(c, data, func(data []byte) {
+				s.decode(c, data)
+			})
+		})
+	default:
+		handler := c.handlers.OnMessageReceive
+		c.dispatch(func() {
+			c.charge(-len(data))
+			c.handling(received)
+			s.handle(c, data, func(data []byte) {
+				handler(c, &data)
+			})
+		})
 	}
 }
 
-func (c *Client) updateDeadline() {
-	idleDeadline := time.Now().Add(c.idleTimeout)
-	c.Conn.SetDeadline(idleDeadline)
+// finish releases a client whose connection has ended, once its queued
+// callbacks are done, and reports the lost connection.
+func (s *Server) finish(c *Client) {
+	c.Conn.Close()
+	c.cancel()
+	c.stopAuthTimer()
+	c.pending.Wait()
+	unsent := c.stopWriter()
+	c.hangUp()
+	s.park(c, unsent)
+	s.waitGroup.Done()
+	s.removeClient(c)
+	c.handlers.OnConnectionLost(c)
 }
 
-func (s *Server) Shutdown() {
-	s.signalCh <- syscall.SIGINT
+// handshakeFailed drops a client whose PROXY protocol header or TLS
+// handshake failed.
+func (s *Server) handshakeFailed(c *Client, err error) {
+	s.logger.Printf("handshake with %v failed: %v", c.Conn.RemoteAddr(), err)
+	if isTimeout(err) {
+		s.onError(c, &TimeoutError{Err: err})
+	}
+	c.Conn.Close()
+	s.abort(c)
 }
 
-func (s *Server) closeConnections() {
+// readFailed logs why reading from a client stopped. End of stream, closed
+// connections and reads interrupted by shutdown are not reported.
+func (s *Server) readFailed(c *Client, err error) {
+	switch {
+	case err == io.EOF, errors.Is(err, net.ErrClosed), s.quitting():
+	case errors.Is(err, ErrSlowClient):
+		s.logger.Printf("slow client: %v", c.Conn.RemoteAddr())
+		s.onError(c, &TimeoutError{Err: err})
+	case isTimeout(err):
+		s.logger.Printf("timeout: %v", c.Conn.RemoteAddr())
+		s.onError(c, &TimeoutError{Err: err})
+	default:
+		s.logger.Printf("Error %s: %v", c.Conn.RemoteAddr(), err)
+		if errors.Is(err, ErrFrameTooLarge) {
+			s.onMessageError(c, err)
+		}
+		if isFramingError(err) {
+			s.onError(c, &FramingError{Err: err})
+		}
+	}
+}
+
+func (s *Server) limitReader(reader *bufio.Reader) io.Reader {
+	if s.maxReadSize > 0 {
+		return &frameReader{r: reader, max: s.maxReadSize}
+	}
+	return reader
+}
+
+// updateDeadline pushes the read deadline ahead by the timeout that applies
+// to the next read, or to the next pace check if that comes first. It
+// returns the deadline of the timeout. The caller must hold c.mu.
+func (c *Client) updateDeadline() time.Time {
+	wait := deadline(c.waitTimeout(c.receiving))
+	next := wait
+	if c.pace != nil && c.receiving {
+		if due := c.pace.deadline(); !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	c.Conn.SetReadDeadline(next)
+	return wait
+}
+
+// waitTimeout is how long a read may wait for data: the read timeout while a
+// message is partly received, the idle timeout between messages. The caller
+// must hold c.mu.
+func (c *Client) waitTimeout(receiving bool) time.Duration {
+	if receiving && c.readTimeout > 0 {
+		return c.readTimeout
+	}
+	return c.idleTimeout
+}
+
+func deadline(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// SetTimeout changes the idle timeout of this client, the longest it may stay
+// silent between messages. It takes effect from the next read; zero disables
+// it.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.idleTimeout = timeout
+	c.mu.Unlock()
+}
+
+func (c *Client) Timeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.idleTimeout
+}
+
+// SetReadTimeout changes how long this client may stall in the middle of a
+// message. Zero falls back to the idle timeout.
+func (c *Client) SetReadTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.readTimeout = timeout
+	c.mu.Unlock()
+}
+
+func (c *Client) ReadTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readTimeout
+}
+
+// SetWriteTimeout changes the deadline Write gives each write to this
+// client. Zero disables it.
+func (c *Client) SetWriteTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	c.writeTimeout = timeout
+	c.mu.Unlock()
+}
+
+func (c *Client) WriteTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeTimeout
+}
+
+func (s *Server) closeConnections() []error {
+	var errs []error
 	s.mu.Lock()
-	for c := range s.clients {
+	for _, c := range s.clients {
 		if c != nil {
-			c.Close()
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %v", c.Conn.RemoteAddr(), err))
+			}
 		}
 	}
 	s.mu.Unlock()
+	return errs
+}
+
+func (s *Server) abort(c *Client) {
+	s.removeClient(c)
+	s.waitGroup.Done()
 }
 
-func (s *Server) addClient(c *Client) {
+func (s *Server) addClient(c *Client) error {
 	s.mu.Lock()
-	s.clients[c] = struct{}{}
-	s.mu.Unlock()
+	defer s.mu.Unlock()
+	if s.quitting() || s.draining {
+		return ErrServerClosed
+	}
+	full := s.maxClients > 0 && len(s.clients)-len(s.evicting) >= s.maxClients
+	if full && !s.evictIdle {
+		return ErrTooManyClients
+	}
+	if ip, ok := knownPeerIP(c.Conn); ok {
+		if err := s.admitLocked(c, ip); err != nil {
+			return err
+		}
+	}
+	if full && !s.evictLocked() {
+		s.releaseLocked(c)
+		return ErrTooManyClients
+	}
+	if s.pool != nil {
+		c.attach(s.pool)
+	}
+	s.clients[c.id] = c
+	s.waitGroup.Add(1)
+	return nil
 }
 
 func (s *Server) removeClient(c *Client) {
 	s.mu.Lock()
-	delete(s.clients, c)
+	delete(s.clients, c.id)
+	delete(s.evicting, c.id)
+	s.rooms.removeClient(c)
+	s.topics.removeClient(c)
+	if c.device != "" && s.devices[c.device] == c {
+		delete(s.devices, c.device)
+	}
+	s.releaseLocked(c)
 	s.mu.Unlock()
 }
 
 func (c *Client) Read(p []byte) (n int, err error) {
-	c.updateDeadline()
-	n, err = c.Conn.Read(p)
-	return
+	for {
+		c.mu.Lock()
+		if c.interrupted {
+			c.mu.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		conn := c.Conn
+		if c.compressing != nil {
+			// Compressed reads start at the next frame boundary.
+			conn = c.compressing.Conn
+		}
+		wait := c.updateDeadline()
+		c.mu.Unlock()
+
+		n, err = conn.Read(p)
+
+		now := time.Now()
+		c.mu.Lock()
+		if n > 0 {
+			c.countRead(n, now)
+		}
+		slow := c.checkPace(now)
+		idle := !c.interrupted && !(c.receiving && c.readTimeout > 0)
+		c.mu.Unlock()
+
+		if n > 0 && c.ingress != nil {
+			wait := c.ingress.reserve(float64(n))
+			c.excusePace(wait)
+			sleep(wait, c.ctx.Done())
+		}
+
+		switch {
+		case slow != nil:
+			return n, slow
+		case n == 0 && isTimeout(err) && (wait.IsZero() || now.Before(wait)):
+			// Only a pace check was due, the peer still has time.
+			continue
+		case n == 0 && isTimeout(err) && idle && c.idleTimedOut():
+			continue
+		}
+		return n, err
+	}
+}
+
+// Write writes to the connection within the client's write timeout. Writes
+// are serialised, so concurrent writers neither interleave nor move each
+// other's deadline. With a write queue, p is queued for the client's writer
+// goroutine instead and Write only waits under QueueBlock.
+func (c *Client) Write(p []byte) (n int, err error) {
+	return c.write(context.Background(), p, PriorityNormal)
+}
+
+func (c *Client) write(ctx context.Context, p []byte, priority Priority) (n int, err error) {
+	c.mu.Lock()
+	q := c.queue
+	c.mu.Unlock()
+	if q == nil {
+		if !c.throttle(ctx.Done(), len(p), 1) {
+			err = ctx.Err()
+		} else {
+			n, err = c.writeConn(ctx, p)
+		}
+		if err != nil {
+			c.writeFailed(err)
+		}
+		return n, err
+	}
+
+	dropped, err := q.push(ctx, p, priority)
+	for i := 0; i < dropped; i++ {
+		c.writeFailed(ErrWriteDropped)
+	}
+	if err != nil {
+		if err == ErrWriteQueueFull {
+			c.Close()
+		}
+		c.writeFailed(err)
+		return 0, err
+	}
+	if c.budget.queued > 0 && !c.withinBudget() {
+		return len(p), ErrMemoryBudget
+	}
+	return len(p), nil
+}
+
+func (c *Client) writeConn(ctx context.Context, p []byte) (n int, err error) {
+	conn, stop, err := c.beginWrite(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n, err = conn.Write(p)
+	return n, c.endWrite(ctx, stop, int64(n), 1, err)
+}
+
+// beginWrite takes the write lock and arms the write deadline of the
+// connection it returns, the earlier of the write timeout and the deadline
+// of ctx. Cancelling ctx interrupts the write. The caller must call
+// endWrite with the returned stop function.
+func (c *Client) beginWrite(ctx context.Context) (net.Conn, func(), error) {
+	select {
+	case c.writeLock <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+
+	c.mu.Lock()
+	conn := c.Conn
+	timeout := c.writeTimeout
+	c.mu.Unlock()
+
+	until := deadline(timeout)
+	if d, ok := ctx.Deadline(); ok && (until.IsZero() || d.Before(until)) {
+		until = d
+	}
+	conn.SetWriteDeadline(until)
+
+	var stop func()
+	if ctx.Done() != nil {
+		fired := make(chan struct{})
+		cancel := context.AfterFunc(ctx, func() {
+			conn.SetWriteDeadline(time.Now())
+			close(fired)
+		})
+		stop = func() {
+			// A deadline set by the interrupt must not outlive this write.
+			if !cancel() {
+				<-fired
+			}
+		}
+	}
+	return conn, stop, nil
+}
+
+// endWrite records n bytes written in msgs messages and releases the write
+// lock. A write that failed because ctx ended reports the context's error.
+func (c *Client) endWrite(ctx context.Context, stop func(), n int64, msgs int, err error) error {
+	if stop != nil {
+		stop()
+	}
+	if n > 0 {
+		c.mu.Lock()
+		c.lastWrite = time.Now()
+		c.stats.BytesOut += n
+		if err == nil {
+			c.stats.MessagesOut += int64(msgs)
+		}
+		c.mu.Unlock()
+	}
+	<-c.writeLock
+
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if d, ok := ctx.Deadline(); ok && isTimeout(err) && !time.Now().Before(d) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// LastRead reports when data was last received from the client.
+func (c *Client) LastRead() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastRead
+}
+
+// LastWrite reports when data was last written to the client with Write.
+func (c *Client) LastWrite() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastWrite
+}
+
+// interrupt wakes a blocked Read and makes further reads fail, so the
+// client's goroutine notices the server is quitting.
+func (c *Client) interrupt() {
+	c.mu.Lock()
+	c.interrupted = true
+	c.Conn.SetReadDeadline(time.Now())
+	detach := c.detach
+	c.mu.Unlock()
+
+	if detach != nil {
+		detach()
+	}
 }
 
 func (c *Client) Close() (err error) {
-	err = c.Conn.Close()
+	c.mu.Lock()
+	conn := c.Conn
+	detach := c.detach
+	c.mu.Unlock()
+	err = conn.Close()
+	if detach != nil {
+		detach()
+	}
+	c.cancel()
+	return
+}
+
+// CloseWrite shuts down the writing side of the connection once queued
+// messages are written, telling the peer that no more data follows while
+// the client goes on reading its answer. A compressed stream is finished
+// first. Datagram connections return ErrNotStream.
+func (c *Client) CloseWrite() error {
+	if err := c.Flush(context.Background()); err != nil {
+		return err
+	}
+	conn, _, err := c.beginWrite(context.Background())
+	if err != nil {
+		return err
+	}
+	return c.endWrite(context.Background(), nil, 0, 0, closeWrite(conn))
+}
+
+func closeWrite(conn net.Conn) error {
+	for {
+		switch c := conn.(type) {
+		case *compressedConn:
+			c.mu.Lock()
+			if closer, ok := c.writer.(io.Closer); ok {
+				closer.Close()
+			}
+			c.mu.Unlock()
+			conn = c.Conn
+		case *sniffConn:
+			conn = c.Conn
+		case *proxyConn:
+			conn = c.Conn
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite()
+		default:
+			return ErrNotStream
+		}
+	}
+}
+
+// ID identifies the client among all the server's connections. IDs are
+// assigned in the order connections are accepted, starting at 1.
+func (c *Client) ID() uint64 {
+	return c.id
+}
+
+// Set stores a value under key on the client, such as session state a
+// handler wants to find again on the next message. Values live as long as
+// the client.
+func (c *Client) Set(key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]any)
+	}
+	c.values[key] = value
+}
+
+// Get returns the value stored under key with Set.
+func (c *Client) Get(key string) (value any, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, ok = c.values[key]
 	return
 }
 
+// Delete removes the value stored under key.
+func (c *Client) Delete(key string) {
+	c.mu.Lock()
+	delete(c.values, key)
+	c.mu.Unlock()
+}
+
+// Context returns a context that is cancelled when the connection closes,
+// for work started on the client's behalf.
+func (c *Client) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Client) isPaused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.paused
+}
+
 func (s *Server) SetTimeout(timeout time.Duration) {
 	s.idleTimeout = timeout
 }
 
+func (s *Server) SetReadTimeout(timeout time.Duration) {
+	s.readTimeout = timeout
+}
+
+func (s *Server) SetWriteTimeout(timeout time.Duration) {
+	s.writeTimeout = timeout
+}
+
+func (s *Server) SetSignalHandling(enabled bool) {
+	s.handleSignal = enabled
+}
+
 func (s *Server) SetMessageDelim(delim byte) {
 	s.messageDelim = delim
 }
 
-func (s *Server) Clients() map[*Client]struct{} {
-	return s.clients
+// RangeClients calls fn for each connected client until fn returns false.
+// The server is locked meanwhile, so fn must not call back into it.
+func (s *Server) RangeClients(fn func(c *Client) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		if !fn(c) {
+			return
+		}
+	}
+}
+
+// ClientCount reports how many clients are connected.
+func (s *Server) ClientCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// FindClient returns the connected client with the given ID, or nil.
+func (s *Server) FindClient(id uint64) *Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clients[id]
+}
+
+type errorList []error
+
+func (l errorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (l errorList) err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
 }
 
+// OnServerStarted sets the callback run once all listeners accept
+// connections. It gets the first listener's address; see Addrs for the rest.
 func (s *Server) OnServerStarted(callback func(addr *net.TCPAddr)) {
 	s.onServerStarted = callback
 }
@@ -242,3 +1672,39 @@ func (s *Server) OnConnectionLost(callback func(c *Client)) {
 func (s *Server) OnMessageReceive(callback func(c *Client, data *[]byte)) {
 	s.onMessageReceive = callback
 }
+
+// OnMessage replaces OnMessageReceive with zero-copy delivery: messages are
+// read into pooled buffers which are recycled when the callback returns.
+// A callback that keeps the message must Retain it and Release it later.
+func (s *Server) OnMessage(callback func(c *Client, m *Message)) {
+	s.onMessage = callback
+}
+
+// OnMessageBatch replaces the other message callbacks with delivery in
+// batches, configured by WithBatching. Each batch holds a client's messages
+// in arrival order.
+func (s *Server) OnMessageBatch(callback func(c *Client, msgs [][]byte)) {
+	s.onMessageBatch = callback
+}
+
+func (s *Server) OnConnectionRejected(callback func(conn net.Conn, reason error)) {
+	s.onConnectionRejected = callback
+}
+
+func (s *Server) OnDraining(callback func()) {
+	s.onDraining = callback
+}
+
+// OnMessageError is called when a message exceeds the maximum message size,
+// with ErrMessageTooLarge, or when the framer fails with ErrFrameTooLarge.
+func (s *Server) OnMessageError(callback func(c *Client, err error)) {
+	s.onMessageError = callback
+}
+
+// OnWriteError is called when data written to a client is not delivered:
+// the write failed or timed out, the send was cancelled, or the write queue
+// overflowed. Every message discarded from a full queue is reported with
+// ErrWriteDropped. It must be set before the server is started.
+func (s *Server) OnWriteError(callback func(c *Client, err error)) {
+	s.onWriteError = callback
+}
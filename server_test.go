@@ -0,0 +1,358 @@
+package brts
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// newServer creates a server for a free local port with newline framing.
+func newServer(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	opts = append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	s := Create("127.0.0.1:0", opts...)
+	s.SetMessageDelim('\n')
+	return s
+}
+
+// start starts s and shuts it down when the test ends.
+func start(t *testing.T, s *Server) {
+	t.Helper()
+	if err := s.StartAsync(); err != nil {
+		t.Fatalf("StartAsync: %v", err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+}
+
+type testConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func dial(t *testing.T, s *Server) *testConn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", s.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *testConn) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := c.Write([]byte(line + "\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *testConn) expect(t *testing.T, want string) {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if got != want+"\n" {
+		t.Fatalf("read %q, want %q", got, want+"\n")
+	}
+}
+
+// waitFor waits for done to be closed or receive a value.
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+// receive waits for a value sent by a callback.
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for callback")
+		panic("unreachable")
+	}
+}
+
+func echo(c *Client, data *[]byte) {
+	c.Conn.Write(append([]byte("echo "), *data...))
+}
+
+func TestShutdown(t *testing.T) {
+	s := newServer(t)
+	lost := make(chan struct{}, 1)
+	s.OnConnectionLost(func(*Client) { lost <- struct{}{} })
+	s.OnMessageReceive(echo)
+	start(t, s)
+
+	conn := dial(t, s)
+	conn.send(t, "hello")
+	conn.expect(t, "echo hello")
+
+	select {
+	case <-s.Done():
+		t.Fatal("Done closed while serving")
+	default:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	waitFor(t, s.Done(), "Done")
+	if err := s.Wait(); err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	waitFor(t, lost, "OnConnectionLost")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.r.ReadByte(); err != io.EOF {
+		t.Fatalf("read after Shutdown: %v, want io.EOF", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	s := newServer(t)
+	lost := make(chan struct{}, 2)
+	s.OnConnectionLost(func(*Client) { lost <- struct{}{} })
+	s.OnMessageReceive(echo)
+
+	for run := 0; run < 2; run++ {
+		if err := s.StartAsync(); err != nil {
+			t.Fatalf("run %d: StartAsync: %v", run, err)
+		}
+		conn := dial(t, s)
+		conn.send(t, "hello")
+		conn.expect(t, "echo hello")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := s.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("run %d: Shutdown: %v", run, err)
+		}
+		if err := s.Wait(); err != nil {
+			t.Fatalf("run %d: Wait: %v", run, err)
+		}
+		waitFor(t, lost, "OnConnectionLost")
+	}
+}
+
+func TestShutdownWaitsForServe(t *testing.T) {
+	s := newServer(t)
+	stopped := make(chan struct{}, 1)
+	s.OnServerStopped(func() { stopped <- struct{}{} })
+	start(t, s)
+	dial(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-stopped:
+	default:
+		t.Fatal("Shutdown returned before OnServerStopped")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Shutdown returned before Done was closed")
+	}
+}
+
+func TestServerStartedOnce(t *testing.T) {
+	s := newServer(t, WithAddresses("127.0.0.1:0"))
+	started := make(chan *net.TCPAddr, 2)
+	s.OnServerStarted(func(addr *net.TCPAddr) { started <- addr })
+	start(t, s)
+
+	if addr := receive(t, started); addr.String() != s.Addr().String() {
+		t.Fatalf("OnServerStarted got %v, want the first address %v", addr, s.Addr())
+	}
+	if n := len(s.Addrs()); n != 2 {
+		t.Fatalf("listening on %d addresses, want 2", n)
+	}
+	select {
+	case addr := <-started:
+		t.Fatalf("OnServerStarted called again with %v", addr)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestWithIdleTimeout(t *testing.T) {
+	s := newServer(t, WithIdleTimeout(0))
+	if s.err != nil || s.idleTimeout != 0 {
+		t.Fatalf("WithIdleTimeout(0): %v, idle timeout %v; want it disabled", s.err, s.idleTimeout)
+	}
+	if err := newServer(t, WithIdleTimeout(-time.Second)).StartAsync(); err == nil {
+		t.Fatal("StartAsync succeeded with a negative idle timeout")
+	}
+}
+
+func TestShutdownBeforeStart(t *testing.T) {
+	s := newServer(t)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+}
+
+func TestStartAsyncBindError(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	s := Create(listener.Addr().String())
+	if err := s.StartAsync(); err == nil {
+		s.Shutdown(context.Background())
+		t.Fatal("StartAsync succeeded on an address in use")
+	}
+}
+
+func TestAddr(t *testing.T) {
+	s := newServer(t)
+	if addr := s.Addr(); addr != nil {
+		t.Fatalf("Addr before start = %v, want nil", addr)
+	}
+	start(t, s)
+	if addr := s.Addr(); addr == nil || addr.Port == 0 {
+		t.Fatalf("Addr = %v, want the bound port", addr)
+	}
+}
+
+// flakyListener fails the first calls to Accept with a temporary error.
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	return l.Listener.Accept()
+}
+
+func TestAcceptRetriesTemporaryErrors(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(t)
+	s.OnMessageReceive(echo)
+	go s.Serve(&flakyListener{Listener: listener, failures: 3})
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+	})
+
+	conn, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	tc := &testConn{Conn: conn, r: bufio.NewReader(conn)}
+	tc.send(t, "hello")
+	tc.expect(t, "echo hello")
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	for _, truncate := range []bool{false, true} {
+		s := newServer(t, WithMaxMessageSize(5, truncate))
+		errs := make(chan error, 1)
+		s.OnMessageError(func(c *Client, err error) { errs <- err })
+		s.OnMessageReceive(echo)
+		start(t, s)
+
+		conn := dial(t, s)
+		conn.send(t, "toolong")
+		select {
+		case err := <-errs:
+			if err != ErrMessageTooLarge {
+				t.Fatalf("truncate %v: OnMessageError got %v, want ErrMessageTooLarge", truncate, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("truncate %v: timed out waiting for OnMessageError", truncate)
+		}
+		if truncate {
+			// The cut message has lost its delimiter.
+			got := make([]byte, len("echo toolo"))
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if _, err := io.ReadFull(conn.r, got); err != nil || string(got) != "echo toolo" {
+				t.Fatalf("read %q, %v; want the truncated message", got, err)
+			}
+		}
+		conn.send(t, "ok")
+		conn.expect(t, "echo ok")
+	}
+}
+
+type failingListener struct {
+	net.Listener
+	err error
+}
+
+func (l failingListener) Accept() (net.Conn, error) {
+	return nil, l.err
+}
+
+func TestAcceptErrorStopsServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken := errors.New("listener broken")
+
+	s := newServer(t)
+	reported := make(chan error, 1)
+	s.OnError(func(c *Client, err error) { reported <- err })
+
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(failingListener{Listener: listener, err: broken}) }()
+
+	err = receive(t, served)
+	var accept *AcceptError
+	if !errors.As(err, &accept) || accept.Temporary || !errors.Is(err, broken) {
+		t.Fatalf("Serve returned %v, want a fatal AcceptError", err)
+	}
+	if err := receive(t, reported); !errors.As(err, &accept) {
+		t.Fatalf("OnError got %v, want an AcceptError", err)
+	}
+	if err := s.Wait(); !errors.Is(err, broken) {
+		t.Fatalf("Wait returned %v, want the accept error", err)
+	}
+}
+
+func TestTemporaryAcceptError(t *testing.T) {
+	if temporaryAcceptError(errors.New("broken")) {
+		t.Error("plain error treated as temporary")
+	}
+	if !temporaryAcceptError(&net.OpError{Op: "accept", Err: os.ErrDeadlineExceeded}) {
+		t.Error("timeout not treated as temporary")
+	}
+	if !temporaryAcceptError(&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}) {
+		t.Error("EMFILE not treated as temporary")
+	}
+}
@@ -0,0 +1,134 @@
+package brts
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"time"
+)
+
+var ErrSessionUnknown = errors.New("brts: unknown or expired session")
+
+const (
+	// DefaultMaxSessions is how many sessions of disconnected clients are
+	// kept at most unless set with WithSessionLimits.
+	DefaultMaxSessions = 10000
+	// DefaultSessionUnsent is how many bytes of unsent messages a session
+	// keeps at most unless set with WithSessionLimits.
+	DefaultSessionUnsent = 1 << 20
+)
+
+// session is the state a disconnected client left behind for a client
+// resuming it.
+type session struct {
+	values map[string]any
+	tags   map[string]struct{}
+	rooms  []string
+	topics []string
+	unsent [][]byte
+	expiry *time.Timer
+}
+
+// park keeps the session of a disconnecting client for the retention time.
+// The session is not kept once the server holds its maximum of sessions,
+// and only the newest unsent messages within the byte limit are kept. It
+// must be called before the client leaves its rooms and topics.
+func (s *Server) park(c *Client, unsent [][]byte) {
+	if s.retention <= 0 {
+		return
+	}
+	if s.sessionBytes > 0 {
+		size := 0
+		for i := len(unsent) - 1; i >= 0; i-- {
+			if size += len(unsent[i]); size > s.sessionBytes {
+				unsent = unsent[i+1:]
+				break
+			}
+		}
+	}
+
+	c.mu.Lock()
+	sess := &session{values: maps.Clone(c.values), tags: maps.Clone(c.tags), unsent: unsent}
+	token := c.token
+	c.mu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSessions > 0 && len(s.sessions) >= s.maxSessions {
+		return
+	}
+	for room := range s.rooms.joined[c] {
+		sess.rooms = append(sess.rooms, room)
+	}
+	for topic := range s.topics.joined[c] {
+		sess.topics = append(sess.topics, topic)
+	}
+	sess.expiry = time.AfterFunc(s.retention, func() {
+		s.mu.Lock()
+		if s.sessions[token] == sess {
+			delete(s.sessions, token)
+		}
+		s.mu.Unlock()
+	})
+	s.sessions[token] = sess
+}
+
+// ResumeSession continues the session of a disconnected client on c, which
+// presented the session's token: c gets the session's values, tags, rooms
+// and subscriptions, and the messages that were still queued for the old
+// connection, within the limit set with WithSessionLimits, are sent. c takes over the token. A session can be resumed
+// once, within the retention time set with WithSessionRetention.
+func (s *Server) ResumeSession(c *Client, token string) error {
+	s.mu.Lock()
+	sess := s.sessions[token]
+	if sess == nil {
+		s.mu.Unlock()
+		return ErrSessionUnknown
+	}
+	if s.clients[c.id] != c {
+		s.mu.Unlock()
+		return ErrClientGone
+	}
+	delete(s.sessions, token)
+	sess.expiry.Stop()
+	for _, room := range sess.rooms {
+		s.rooms.add(c, room)
+	}
+	for _, topic := range sess.topics {
+		s.topics.add(c, topic)
+	}
+
+	c.mu.Lock()
+	c.token = token
+	for key, value := range sess.values {
+		if _, ok := c.values[key]; !ok {
+			if c.values == nil {
+				c.values = make(map[string]any)
+			}
+			c.values[key] = value
+		}
+	}
+	for tag := range sess.tags {
+		if c.tags == nil {
+			c.tags = make(map[string]struct{})
+		}
+		c.tags[tag] = struct{}{}
+	}
+	c.mu.Unlock()
+	s.mu.Unlock()
+
+	for _, p := range sess.unsent {
+		if _, err := c.write(context.Background(), p, PriorityNormal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SessionToken returns the token a client presents to resume its session
+// after reconnecting, when sessions are enabled with WithSessionRetention.
+func (c *Client) SessionToken() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
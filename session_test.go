@@ -0,0 +1,24 @@
+package brts
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParkLimits(t *testing.T) {
+	s := newServer(t, WithSessionRetention(time.Minute), WithSessionLimits(1, 4))
+	if s.err != nil {
+		t.Fatal(s.err)
+	}
+	s.park(&Client{mu: &sync.Mutex{}, token: "a"}, [][]byte{[]byte("old"), []byte("ab"), []byte("cd")})
+	s.park(&Client{mu: &sync.Mutex{}, token: "b"}, nil)
+	defer s.sessions["a"].expiry.Stop()
+
+	if len(s.sessions) != 1 || s.sessions["b"] != nil {
+		t.Fatalf("kept %d sessions, want only the first", len(s.sessions))
+	}
+	if unsent := s.sessions["a"].unsent; len(unsent) != 2 || string(unsent[0]) != "ab" {
+		t.Fatalf("kept unsent %q, want the newest 4 bytes", unsent)
+	}
+}
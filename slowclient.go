@@ -0,0 +1,122 @@
+package brts
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrSlowClient = errors.New("brts: client too slow")
+
+// pacer holds a client to a minimum pace while a message is partly
+// received: the whole message within frameTimeout, and at least minBytes in
+// every interval. Clients trickling bytes to hold a socket open are
+// disconnected with ErrSlowClient.
+type pacer struct {
+	frameTimeout time.Duration
+	minBytes     int
+	interval     time.Duration
+
+	started time.Time
+	window  time.Time
+	bytes   int
+}
+
+func (s *Server) newPacer() *pacer {
+	if s.frameTimeout <= 0 && s.minReadRate <= 0 {
+		return nil
+	}
+	return &pacer{
+		frameTimeout: s.frameTimeout,
+		minBytes:     s.minReadRate,
+		interval:     s.rateInterval,
+	}
+}
+
+func (p *pacer) start(now time.Time) {
+	p.started = now
+	p.window = now
+	p.bytes = 0
+}
+
+// deadline is when the pace has to be checked next.
+func (p *pacer) deadline() time.Time {
+	var due time.Time
+	if p.frameTimeout > 0 {
+		due = p.started.Add(p.frameTimeout)
+	}
+	if p.minBytes > 0 {
+		if end := p.window.Add(p.interval); due.IsZero() || end.Before(due) {
+			due = end
+		}
+	}
+	return due
+}
+
+func (p *pacer) check(now time.Time) error {
+	if p.frameTimeout > 0 && now.Sub(p.started) >= p.frameTimeout {
+		return ErrSlowClient
+	}
+	if p.minBytes > 0 && now.Sub(p.window) >= p.interval {
+		if p.bytes < p.minBytes {
+			return ErrSlowClient
+		}
+		p.window = now
+		p.bytes = 0
+	}
+	return nil
+}
+
+// startMessage is called before each message is read, with whether some of
+// it has already been received.
+func (c *Client) startMessage(receiving bool) {
+	c.mu.Lock()
+	c.receiving = receiving
+	if receiving && c.pace != nil {
+		c.pace.start(time.Now())
+	}
+	c.mu.Unlock()
+}
+
+// countRead records n bytes read from the peer. The caller must hold c.mu.
+func (c *Client) countRead(n int, now time.Time) {
+	c.lastRead = now
+	c.stats.BytesIn += int64(n)
+	if !c.receiving {
+		c.receiving = true
+		if c.pace != nil {
+			c.pace.start(now)
+		}
+	}
+	if c.pace != nil {
+		c.pace.bytes += n
+	}
+}
+
+// checkPace reports ErrSlowClient when a partly received message is not
+// arriving fast enough. The caller must hold c.mu.
+func (c *Client) checkPace(now time.Time) error {
+	if c.pace == nil || !c.receiving {
+		return nil
+	}
+	return c.pace.check(now)
+}
+
+// excusePace moves the pace on by d the server held off reading, so ingress
+// throttling is not taken for a slow client.
+func (c *Client) excusePace(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	c.mu.Lock()
+	if c.pace != nil && c.receiving {
+		c.pace.started = c.pace.started.Add(d)
+		c.pace.window = c.pace.window.Add(d)
+	}
+	c.mu.Unlock()
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,230 @@
+package brts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"net"
+	"regexp"
+	"time"
+)
+
+const (
+	sniffTimeout = 5 * time.Second
+	sniffSize    = 256
+)
+
+// Traffic is the kind of a connection as told by its first bytes.
+type Traffic int
+
+const (
+	// TrafficUnknown is reported for connections that were not sniffed or
+	// sent nothing within the sniff timeout.
+	TrafficUnknown Traffic = iota
+	TrafficTLS
+	TrafficText
+	TrafficBinary
+)
+
+func (t Traffic) String() string {
+	switch t {
+	case TrafficTLS:
+		return "tls"
+	case TrafficText:
+		return "text"
+	case TrafficBinary:
+		return "binary"
+	default:
+		return "unknown"
+	}
+}
+
+// sniffConn replays the bytes that were peeked at before the connection was
+// handed on.
+type sniffConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *sniffConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// classify tells the kind of traffic from the first bytes of a connection: a
+// TLS handshake record, printable text or anything else.
+func classify(head []byte) Traffic {
+	if len(head) == 0 {
+		return TrafficUnknown
+	}
+	if head[0] == 0x16 && (len(head) < 2 || head[1] == 0x03) {
+		return TrafficTLS
+	}
+	for _, b := range head {
+		if (b < 0x20 || b == 0x7f) && b != '\t' && b != '\r' && b != '\n' {
+			return TrafficBinary
+		}
+	}
+	return TrafficText
+}
+
+// Match is a Matcher's verdict on the first bytes of a connection.
+type Match int
+
+const (
+	// MatchMore asks to be called again once more bytes arrived.
+	MatchMore Match = iota
+	MatchYes
+	// MatchNo rules the protocol out, whatever bytes follow.
+	MatchNo
+)
+
+// Matcher tells whether the first bytes received on a connection belong to
+// a protocol. It is called again as more bytes arrive while it returns
+// MatchMore.
+type Matcher func(head []byte) Match
+
+type matchRoute struct {
+	name     string
+	match    Matcher
+	handlers Handlers
+}
+
+// MatchPrefix matches connections that start with any of the given magic
+// bytes.
+func MatchPrefix(magic ...[]byte) Matcher {
+	return func(head []byte) Match {
+		verdict := MatchNo
+		for _, m := range magic {
+			if bytes.HasPrefix(head, m) {
+				return MatchYes
+			}
+			if bytes.HasPrefix(m, head) {
+				verdict = MatchMore
+			}
+		}
+		return verdict
+	}
+}
+
+// MatchFirstLine matches connections whose first line, without its line
+// ending, matches re. It waits for the line to be complete.
+func MatchFirstLine(re *regexp.Regexp) Matcher {
+	return func(head []byte) Match {
+		line, _, ok := bytes.Cut(head, []byte{'\n'})
+		switch {
+		case !ok:
+			return MatchMore
+		case re.Match(bytes.TrimSuffix(line, []byte{'\r'})):
+			return MatchYes
+		default:
+			return MatchNo
+		}
+	}
+}
+
+// MatchTraffic matches connections whose first bytes are of the given kind.
+func MatchTraffic(t Traffic) Matcher {
+	return func(head []byte) Match {
+		if classify(head) == t {
+			return MatchYes
+		}
+		return MatchNo
+	}
+}
+
+// HandleMatch registers a protocol served on a shared port: plain
+// connections whose first bytes are accepted by match get their own set of
+// callbacks. A protocol is chosen as soon as its matcher accepts the bytes
+// received so far, trying protocols in the order they were registered.
+// Connections every matcher ruled out, or nothing matched within 256 bytes
+// or five seconds, fall back to HandleTraffic and the server-wide
+// callbacks.
+func (s *Server) HandleMatch(name string, match Matcher, handlers Handlers) {
+	s.mu.Lock()
+	s.matchRoutes = append(s.matchRoutes, &matchRoute{name: name, match: match, handlers: handlers})
+	s.mu.Unlock()
+}
+
+// HandleTraffic routes plain connections whose first bytes are of the given
+// kind to their own set of callbacks, so devices speaking different
+// protocols can share a port. Unset callbacks fall back to the server-wide
+// ones. Routing waits for the client to send first; connections that stay
+// silent for five seconds are served with the server-wide callbacks.
+func (s *Server) HandleTraffic(t Traffic, handlers Handlers) {
+	s.mu.Lock()
+	s.trafficRoutes[t] = handlers
+	s.mu.Unlock()
+}
+
+func (s *Server) sniffing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.detectTLS || len(s.trafficRoutes) > 0 || len(s.matchRoutes) > 0
+}
+
+// matchHead returns the first route that accepts head, or whether any route
+// may still accept it once more bytes arrived.
+func (s *Server) matchHead(head []byte) (matched *matchRoute, more bool) {
+	s.mu.Lock()
+	routes := s.matchRoutes
+	s.mu.Unlock()
+
+	for _, route := range routes {
+		switch route.match(head) {
+		case MatchYes:
+			return route, false
+		case MatchMore:
+			more = true
+		}
+	}
+	return nil, more
+}
+
+// sniff peeks at the first bytes of the connection, records their kind and
+// the protocol they match. With TLS detection on, a TLS handshake is
+// terminated here and anything else is served in plaintext. Read errors are
+// left for the read loop to report.
+func (s *Server) sniff(c *Client) {
+	if _, ok := c.Conn.(*udpConn); ok || !s.sniffing() {
+		return
+	}
+
+	conn := &sniffConn{Conn: c.Conn, reader: bufio.NewReaderSize(c.Conn, sniffSize)}
+	c.Conn = conn
+
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var head []byte
+	for len(head) < sniffSize {
+		if _, err := conn.reader.Peek(len(head) + 1); err != nil {
+			break
+		}
+		head, _ = conn.reader.Peek(conn.reader.Buffered())
+
+		c.traffic = classify(head)
+		if c.traffic == TrafficTLS && s.detectTLS {
+			c.Conn = tls.Server(conn, s.serverTLSConfig())
+			return
+		}
+		var more bool
+		if c.matched, more = s.matchHead(head); !more {
+			return
+		}
+	}
+}
+
+// Traffic reports the kind of traffic the connection started with, when the
+// server sniffs connections.
+func (c *Client) Traffic() Traffic {
+	return c.traffic
+}
+
+// MatchedProtocol reports the name of the protocol registered with
+// HandleMatch that the connection was routed to.
+func (c *Client) MatchedProtocol() string {
+	if c.matched == nil {
+		return ""
+	}
+	return c.matched.name
+}
@@ -0,0 +1,159 @@
+package brts
+
+import (
+	"crypto/tls"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		head []byte
+		want Traffic
+	}{
+		{nil, TrafficUnknown},
+		{[]byte{0x16, 0x03, 0x01}, TrafficTLS},
+		{[]byte{0x16}, TrafficTLS},
+		{[]byte("GET / HTTP/1.1\r\n"), TrafficText},
+		{[]byte{0x78, 0x01, 0x00}, TrafficBinary},
+	}
+	for _, tt := range tests {
+		if got := classify(tt.head); got != tt.want {
+			t.Errorf("classify(%q) = %v, want %v", tt.head, got, tt.want)
+		}
+	}
+}
+
+func TestMatchers(t *testing.T) {
+	prefix := MatchPrefix([]byte("MQTT"), []byte{0x10})
+	firstLine := MatchFirstLine(regexp.MustCompile(`^HELLO \w+$`))
+	tests := []struct {
+		name    string
+		matcher Matcher
+		head    string
+		want    Match
+	}{
+		{"prefix partial", prefix, "MQ", MatchMore},
+		{"prefix whole", prefix, "MQTT\x04", MatchYes},
+		{"prefix byte", prefix, "\x10", MatchYes},
+		{"prefix other", prefix, "GET", MatchNo},
+		{"line incomplete", firstLine, "HELLO dev", MatchMore},
+		{"line crlf", firstLine, "HELLO dev\r\n", MatchYes},
+		{"line other", firstLine, "BYE\n", MatchNo},
+		{"traffic", MatchTraffic(TrafficText), "text", MatchYes},
+		{"traffic other", MatchTraffic(TrafficText), "\x00\x01", MatchNo},
+	}
+	for _, tt := range tests {
+		if got := tt.matcher([]byte(tt.head)); got != tt.want {
+			t.Errorf("%s: matcher(%q) = %v, want %v", tt.name, tt.head, got, tt.want)
+		}
+	}
+}
+
+type routed struct {
+	route string
+	data  string
+}
+
+func routeTo(got chan<- routed, route string) Handlers {
+	return Handlers{OnMessageReceive: func(c *Client, data *[]byte) {
+		r := routed{route, string(*data)}
+		if c.TLSState() != nil {
+			r.route += "+tls"
+		}
+		got <- r
+	}}
+}
+
+func TestSniffRouting(t *testing.T) {
+	s := newServer(t)
+	got := make(chan routed, 4)
+	s.HandleTraffic(TrafficBinary, routeTo(got, "binary"))
+	s.OnMessageReceive(routeTo(got, "default").OnMessageReceive)
+	start(t, s)
+
+	tests := []struct {
+		name string
+		data string
+		want routed
+	}{
+		{"binary", "\x01\x02\n", routed{"binary", "\x01\x02\n"}},
+		{"text", "text\n", routed{"default", "text\n"}},
+	}
+	for _, tt := range tests {
+		conn := dial(t, s)
+		conn.Write([]byte(tt.data))
+		if r := receive(t, got); r != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, r, tt.want)
+		}
+	}
+}
+
+func TestTLSDetection(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t, WithTLS(config), WithTLSDetection(true))
+	got := make(chan routed, 2)
+	s.OnMessageReceive(routeTo(got, "default").OnMessageReceive)
+	start(t, s)
+
+	dialTLS(t, s, &tls.Config{ServerName: "a.test"}).send(t, "secure")
+	if r := receive(t, got); r != (routed{"default+tls", "secure\n"}) {
+		t.Errorf("TLS client: got %+v", r)
+	}
+	dial(t, s).send(t, "plain")
+	if r := receive(t, got); r != (routed{"default", "plain\n"}) {
+		t.Errorf("plaintext client: got %+v", r)
+	}
+}
+
+func TestMatchRouting(t *testing.T) {
+	s := newServer(t)
+	got := make(chan routed, 4)
+	handler := func(route string) Handlers {
+		return Handlers{OnMessageReceive: func(c *Client, data *[]byte) {
+			got <- routed{route + "/" + c.MatchedProtocol(), string(*data)}
+		}}
+	}
+	s.HandleMatch("hello", MatchFirstLine(regexp.MustCompile(`^HELLO`)), handler("match"))
+	s.HandleMatch("binary", MatchTraffic(TrafficBinary), handler("binary"))
+	s.OnMessageReceive(handler("default").OnMessageReceive)
+	start(t, s)
+
+	tests := []struct {
+		name   string
+		chunks []string
+		want   routed
+	}{
+		{"matched", []string{"HELLO dev\n"}, routed{"match/hello", "HELLO dev\n"}},
+		// The matcher waits for the rest of the line before deciding.
+		{"matched in parts", []string{"HEL", "LO split\n"}, routed{"match/hello", "HELLO split\n"}},
+		{"binary", []string{"\x01\x02\n"}, routed{"binary/binary", "\x01\x02\n"}},
+		// Every matcher rules the line out, so it is served at once.
+		{"fallback", []string{"other\n"}, routed{"default/", "other\n"}},
+	}
+	for _, tt := range tests {
+		conn := dial(t, s)
+		for _, chunk := range tt.chunks {
+			conn.Write([]byte(chunk))
+			time.Sleep(20 * time.Millisecond)
+		}
+		if r := receive(t, got); r != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, r, tt.want)
+		}
+	}
+}
+
+func TestSniffedTLSState(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t, WithTLS(config))
+	got := make(chan routed, 1)
+	s.HandleTraffic(TrafficText, routeTo(got, "text"))
+	start(t, s)
+
+	// The listener terminates TLS and the decrypted stream is sniffed.
+	dialTLS(t, s, &tls.Config{ServerName: "a.test"}).send(t, "secure")
+	if r := receive(t, got); r != (routed{"text+tls", "secure\n"}) {
+		t.Errorf("got %+v", r)
+	}
+}
@@ -0,0 +1,30 @@
+package brts
+
+import (
+	"time"
+)
+
+// ClientStats is a snapshot of a client's traffic.
+type ClientStats struct {
+	BytesIn     int64
+	BytesOut    int64
+	MessagesIn  int64
+	MessagesOut int64
+	// Connected is when the connection was accepted.
+	Connected time.Time
+	// LastActivity is when data was last read or written, or Connected
+	// before any was.
+	LastActivity time.Time
+}
+
+// Stats reports the bytes and messages received from and written to the
+// client so far, and when it was last active. Bytes are counted as the
+// handlers see them, after TLS and decompression.
+func (c *Client) Stats() ClientStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Connected = c.connected
+	stats.LastActivity = c.lastActive()
+	return stats
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package brts
+
+import (
+	"net"
+	"time"
+)
+
+func systemdListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+func sdNotify(state string) error {
+	return nil
+}
+
+func watchdogInterval() time.Duration {
+	return 0
+}
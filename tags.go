@@ -0,0 +1,57 @@
+package brts
+
+import (
+	"slices"
+)
+
+// AddTag classifies the client, for instance by firmware version, region
+// or tenant, so ClientsByTag finds it.
+func (c *Client) AddTag(tag string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.tags == nil {
+		c.tags = make(map[string]struct{})
+	}
+	c.tags[tag] = struct{}{}
+}
+
+// RemoveTag removes a tag added with AddTag.
+func (c *Client) RemoveTag(tag string) {
+	c.mu.Lock()
+	delete(c.tags, tag)
+	c.mu.Unlock()
+}
+
+// HasTag reports whether the client has the tag, such as in a
+// BroadcastFunc filter.
+func (c *Client) HasTag(tag string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.tags[tag]
+	return ok
+}
+
+// Tags returns the client's tags, sorted.
+func (c *Client) Tags() []string {
+	c.mu.Lock()
+	tags := make([]string, 0, len(c.tags))
+	for tag := range c.tags {
+		tags = append(tags, tag)
+	}
+	c.mu.Unlock()
+	slices.Sort(tags)
+	return tags
+}
+
+// ClientsByTag returns the connected clients that have the tag.
+func (s *Server) ClientsByTag(tag string) []*Client {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var clients []*Client
+	for _, c := range s.clients {
+		if c.HasTag(tag) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
@@ -0,0 +1,305 @@
+package brts
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const certCheckInterval = time.Second
+
+var ErrTLSUpgrade = errors.New("brts: connection can not be upgraded to tls")
+
+func (s *Server) StartTLS(certFile, keyFile string) error {
+	if err := WithCertificateFiles(certFile, keyFile)(s); err != nil {
+		return err
+	}
+	return s.Start()
+}
+
+func (s *Server) setGetCertificate(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if s.tlsConfig != nil {
+		config = s.tlsConfig.Clone()
+	}
+	config.GetCertificate = getCertificate
+	s.tlsConfig = config
+}
+
+// certReloader serves a certificate loaded from disk and reloads it when the
+// certificate or key file changes, so certificates can be rotated without a
+// restart. A failed reload keeps the previous certificate.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		if modTime, err := r.lastModified(); err == nil && !modTime.Equal(r.modTime) {
+			r.load()
+		}
+	}
+	return r.cert, nil
+}
+
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, l.config), nil
+}
+
+func (s *Server) serverTLSConfig() *tls.Config {
+	s.mu.Lock()
+	config := s.tlsConfig.Clone()
+	if s.clientAuth != tls.NoClientCert {
+		config.ClientAuth = s.clientAuth
+		config.ClientCAs = s.clientCAs
+	}
+
+	for proto := range s.protocolHandlers {
+		if !containsString(config.NextProtos, proto) {
+			config.NextProtos = append(config.NextProtos, proto)
+		}
+	}
+	s.mu.Unlock()
+	return config
+}
+
+// HandleServerName routes TLS connections that requested the given SNI host
+// name to their own set of callbacks. Unset callbacks fall back to the
+// server-wide ones.
+func (s *Server) HandleServerName(name string, handlers Handlers) {
+	s.mu.Lock()
+	s.serverNameHandlers[strings.ToLower(name)] = handlers
+	s.mu.Unlock()
+}
+
+// HandleProtocol routes TLS connections that negotiated the given ALPN
+// protocol to their own set of callbacks. It takes precedence over
+// HandleServerName and must be called before the server is started.
+func (s *Server) HandleProtocol(proto string, handlers Handlers) {
+	s.mu.Lock()
+	s.protocolHandlers[proto] = handlers
+	s.mu.Unlock()
+}
+
+func (s *Server) handlersFor(c *Client) Handlers {
+	handlers := Handlers{
+		OnNewConnection:  s.onNewConnection,
+		OnConnectionLost: s.onConnectionLost,
+		OnMessageReceive: s.onMessageReceive,
+		OnMessage:        s.onMessage,
+	}
+
+	s.mu.Lock()
+	route, ok := Handlers{}, false
+	if state := c.TLSState(); state != nil {
+		route, ok = s.protocolHandlers[state.NegotiatedProtocol]
+		if !ok || state.NegotiatedProtocol == "" {
+			route, ok = s.serverNameHandlers[strings.ToLower(state.ServerName)]
+		}
+	}
+	if !ok && c.matched != nil {
+		route, ok = c.matched.handlers, true
+	}
+	if !ok && c.traffic != TrafficUnknown {
+		route, ok = s.trafficRoutes[c.traffic]
+	}
+	s.mu.Unlock()
+
+	if ok {
+		if route.OnNewConnection != nil {
+			handlers.OnNewConnection = route.OnNewConnection
+		}
+		if route.OnConnectionLost != nil {
+			handlers.OnConnectionLost = route.OnConnectionLost
+		}
+		if route.OnMessageReceive != nil || route.OnMessage != nil {
+			handlers.OnMessage = route.OnMessage
+		}
+		if route.OnMessageReceive != nil {
+			handlers.OnMessageReceive = route.OnMessageReceive
+		}
+	}
+	return handlers
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Client) handshake() error {
+	conn, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	return c.handshakeTLS(conn)
+}
+
+// handshakeTLS runs the handshake within the idle timeout, which bounds its
+// writes as well as its reads.
+func (c *Client) handshakeTLS(conn *tls.Conn) error {
+	c.mu.Lock()
+	conn.SetDeadline(deadline(c.idleTimeout))
+	c.mu.Unlock()
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+func (c *Client) TLSState() *tls.ConnectionState {
+	conn, ok := plainConn(c.Conn).(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := conn.ConnectionState()
+	return &state
+}
+
+func (c *Client) PeerCertificates() []*x509.Certificate {
+	state := c.TLSState()
+	if state == nil {
+		return nil
+	}
+	return state.PeerCertificates
+}
+
+func (c *Client) CommonName() string {
+	certs := c.PeerCertificates()
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+func (c *Client) SubjectAltNames() []string {
+	certs := c.PeerCertificates()
+	if len(certs) == 0 {
+		return nil
+	}
+
+	cert := certs[0]
+	var names []string
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	return names
+}
+
+// UpgradeTLS performs a server-side TLS handshake on the plaintext connection.
+// It is meant to be called from OnMessageReceive after the peer asked for the
+// upgrade and must not send anything else until the handshake completes.
+// Clients served by an event engine read the raw socket, and with a worker
+// pool the read loop goes on reading during the callback, so neither can be
+// upgraded.
+func (c *Client) UpgradeTLS(config *tls.Config) error {
+	c.mu.Lock()
+	_, compressed := c.Conn.(*compressedConn)
+	switch plainConn(c.Conn).(type) {
+	case *tls.Conn, *udpConn:
+		c.mu.Unlock()
+		return ErrTLSUpgrade
+	}
+	if compressed || c.detach != nil || c.pool != nil {
+		c.mu.Unlock()
+		return ErrTLSUpgrade
+	}
+
+	// The handshake starts with what the read loop buffered past the
+	// message that asked for the upgrade.
+	raw := c.Conn
+	if br := c.reader; br != nil && br.Buffered() > 0 {
+		n := br.Buffered()
+		pending, _ := br.Peek(n)
+		source := io.MultiReader(bytes.NewReader(bytes.Clone(pending)), raw)
+		raw = &sniffConn{Conn: raw, reader: bufio.NewReader(source)}
+		br.Discard(n)
+	}
+	conn := tls.Server(raw, config)
+	c.Conn = conn
+	c.mu.Unlock()
+
+	if err := c.handshakeTLS(conn); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.updateDeadline()
+	c.mu.Unlock()
+	return nil
+}
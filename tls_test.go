@@ -0,0 +1,212 @@
+package brts
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// testCertificate returns a self-signed certificate for a.test, b.test and
+// 127.0.0.1.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "brts test"},
+		DNSNames:     []string{"a.test", "b.test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func dialTLS(t *testing.T, s *Server, config *tls.Config) *testConn {
+	t.Helper()
+	config.InsecureSkipVerify = true
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", s.Addr().String(), config)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestTLSRouting(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t, WithTLS(config))
+	got := make(chan string, 3)
+	handler := func(route string) Handlers {
+		return Handlers{OnMessageReceive: func(c *Client, data *[]byte) {
+			got <- route + " " + string(*data)
+		}}
+	}
+	s.HandleServerName("a.test", handler("name"))
+	s.HandleProtocol("proto-b", handler("protocol"))
+	s.OnMessageReceive(handler("default").OnMessageReceive)
+	start(t, s)
+
+	tests := []struct {
+		name   string
+		config *tls.Config
+		want   string
+	}{
+		{"server name", &tls.Config{ServerName: "a.test"}, "name"},
+		{"protocol", &tls.Config{ServerName: "a.test", NextProtos: []string{"proto-b"}}, "protocol"},
+		{"other name", &tls.Config{ServerName: "b.test"}, "default"},
+	}
+	for _, tt := range tests {
+		conn := dialTLS(t, s, tt.config)
+		conn.send(t, tt.name)
+		select {
+		case r := <-got:
+			if want := tt.want + " " + tt.name + "\n"; r != want {
+				t.Errorf("%s: got %q, want %q", tt.name, r, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: timed out waiting for the message", tt.name)
+		}
+	}
+}
+
+func TestUpgradeTLS(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t)
+	got := make(chan string, 2)
+	upgraded := make(chan error, 1)
+	s.OnMessageReceive(func(c *Client, data *[]byte) {
+		if string(*data) == "STARTTLS\n" {
+			c.Conn.Write([]byte("OK\n"))
+			upgraded <- c.UpgradeTLS(config)
+			return
+		}
+		got <- c.TLSState().ServerName + " " + string(*data)
+	})
+	start(t, s)
+
+	conn := dial(t, s)
+	conn.send(t, "STARTTLS")
+	conn.expect(t, "OK")
+	secure := tls.Client(conn.Conn, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	if err := secure.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	select {
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatalf("UpgradeTLS: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for UpgradeTLS")
+	}
+
+	secure.Write([]byte("secret\n"))
+	select {
+	case r := <-got:
+		if r != "a.test secret\n" {
+			t.Fatalf("got %q after the upgrade", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message after the upgrade")
+	}
+}
+
+func TestUpgradeTLSTwice(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t)
+	s.OnMessageReceive(func(c *Client, data *[]byte) {
+		if string(*data) == "STARTTLS\n" {
+			c.Conn.Write([]byte("OK\n"))
+			c.UpgradeTLS(config)
+			return
+		}
+		if err := c.UpgradeTLS(config); err != ErrTLSUpgrade {
+			c.Conn.Write([]byte("upgraded again\n"))
+			return
+		}
+		c.Conn.Write([]byte("refused\n"))
+	})
+	start(t, s)
+
+	conn := dial(t, s)
+	conn.send(t, "STARTTLS")
+	conn.expect(t, "OK")
+	secure := tls.Client(conn.Conn, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	secure.Write([]byte("again\n"))
+	buf := make([]byte, 64)
+	secure.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := secure.Read(buf)
+	if err != nil || string(buf[:n]) != "refused\n" {
+		t.Fatalf("read %q, %v; want the second upgrade refused", buf[:n], err)
+	}
+}
+
+// pipelinedConn sends prefix along with the first write.
+type pipelinedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *pipelinedConn) Write(p []byte) (int, error) {
+	if c.prefix != nil {
+		_, err := c.Conn.Write(append(c.prefix, p...))
+		c.prefix = nil
+		return len(p), err
+	}
+	return c.Conn.Write(p)
+}
+
+func TestUpgradeTLSPipelined(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t)
+	upgraded := make(chan error, 1)
+	s.OnMessageReceive(func(c *Client, data *[]byte) {
+		upgraded <- c.UpgradeTLS(config)
+	})
+	start(t, s)
+
+	// The ClientHello arrives in the same read as the request to upgrade.
+	conn := dial(t, s)
+	pipelined := &pipelinedConn{Conn: conn.Conn, prefix: []byte("STARTTLS\n")}
+	secure := tls.Client(pipelined, &tls.Config{ServerName: "a.test", InsecureSkipVerify: true})
+	secure.SetDeadline(time.Now().Add(2 * time.Second))
+	if err := secure.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if err := receive(t, upgraded); err != nil {
+		t.Fatalf("UpgradeTLS: %v", err)
+	}
+}
+
+func TestUpgradeTLSWithWorkers(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}}
+	s := newServer(t, WithWorkers(2, 16))
+	upgraded := make(chan error, 1)
+	s.OnMessageReceive(func(c *Client, data *[]byte) {
+		upgraded <- c.UpgradeTLS(config)
+	})
+	start(t, s)
+
+	dial(t, s).send(t, "STARTTLS")
+	if err := receive(t, upgraded); err != ErrTLSUpgrade {
+		t.Fatalf("UpgradeTLS returned %v, want ErrTLSUpgrade", err)
+	}
+}
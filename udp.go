@@ -0,0 +1,292 @@
+package brts
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	udpScheme       = "udp://"
+	maxDatagramSize = 64 * 1024
+	udpInboxSize    = 64
+)
+
+var errDeadline = &timeoutError{}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// udpListener turns a UDP socket into a net.Listener: the first datagram from
+// a remote address accepts a new session conn, later datagrams from the same
+// address are delivered to that session until it is closed.
+type udpListener struct {
+	conn      *net.UDPConn
+	mu        sync.Mutex
+	sessions  map[string]*udpConn
+	acceptCh  chan *udpConn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func listenUDP(lc *net.ListenConfig, address string) (*udpListener, error) {
+	pc, err := lc.ListenPacket(context.Background(), "udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, errors.New("brts: not a udp socket")
+	}
+	return newUDPListener(conn), nil
+}
+
+func newUDPListener(conn *net.UDPConn) *udpListener {
+	l := &udpListener{
+		conn:     conn,
+		sessions: make(map[string]*udpConn),
+		acceptCh: make(chan *udpConn),
+		closed:   make(chan struct{}),
+	}
+	go l.readLoop()
+	return l
+}
+
+func (l *udpListener) readLoop() {
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, raddr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			l.Close()
+			return
+		}
+
+		data := make([]byte, n)
+		copy(data, buf[:n])
+
+		key := raddr.String()
+		l.mu.Lock()
+		session, ok := l.sessions[key]
+		if !ok {
+			session = newUDPConn(l, raddr)
+			l.sessions[key] = session
+		}
+		l.mu.Unlock()
+
+		if !ok {
+			select {
+			case l.acceptCh <- session:
+			case <-l.closed:
+				return
+			}
+		}
+		session.deliver(data)
+	}
+}
+
+func (l *udpListener) Accept() (net.Conn, error) {
+	select {
+	case session := <-l.acceptCh:
+		return session, nil
+	case <-l.closed:
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, errors.New("brts: udp listener closed")
+	}
+}
+
+func (l *udpListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.conn.Close()
+	})
+	return err
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) File() (*os.File, error) {
+	return l.conn.File()
+}
+
+func (l *udpListener) remove(c *udpConn) {
+	l.mu.Lock()
+	if l.sessions[c.raddr.String()] == c {
+		delete(l.sessions, c.raddr.String())
+	}
+	l.mu.Unlock()
+}
+
+// udpConn is a logical session with one remote address. Each Read returns a
+// single datagram; datagrams are dropped when the session inbox is full.
+type udpConn struct {
+	listener  *udpListener
+	raddr     *net.UDPAddr
+	inbox     chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	wake      chan struct{}
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUDPConn(l *udpListener, raddr *net.UDPAddr) *udpConn {
+	return &udpConn{
+		listener: l,
+		raddr:    raddr,
+		inbox:    make(chan []byte, udpInboxSize),
+		closed:   make(chan struct{}),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+func (c *udpConn) deliver(data []byte) {
+	select {
+	case c.inbox <- data:
+	default:
+	}
+}
+
+func (c *udpConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, errDeadline
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		select {
+		case data := <-c.inbox:
+			stopTimer(timer)
+			return copy(p, data), nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, io.EOF
+		case <-c.listener.closed:
+			stopTimer(timer)
+			return 0, io.EOF
+		case <-c.wake:
+			// The read deadline changed, wait again with the new one.
+			stopTimer(timer)
+		case <-timeout:
+			return 0, errDeadline
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// deadlineChanged wakes a blocked Read so it picks up a new read deadline.
+func (c *udpConn) deadlineChanged() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *udpConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errors.New("brts: udp session closed")
+	default:
+	}
+
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return 0, errDeadline
+	}
+	return c.listener.conn.WriteToUDP(p, c.raddr)
+}
+
+func (c *udpConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.listener.remove(c)
+	})
+	return nil
+}
+
+func (c *udpConn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *udpConn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *udpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.deadlineChanged()
+	return nil
+}
+
+func (c *udpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.deadlineChanged()
+	return nil
+}
+
+func (c *udpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+// readDatagram appends the next datagram to dst. Without a buffer to fill
+// it reads into pooled scratch space and returns an exact-size copy.
+func (c *Client) readDatagram(dst []byte) ([]byte, error) {
+	if dst == nil {
+		buf := datagramPool.Get().(*[]byte)
+		defer datagramPool.Put(buf)
+
+		n, err := c.Read(*buf)
+		return append([]byte(nil), (*buf)[:n]...), err
+	}
+
+	start := len(dst)
+	grown := slices.Grow(dst, maxDatagramSize)
+	n, err := c.Read(grown[start : start+maxDatagramSize])
+	return grown[:start+n], err
+}
@@ -0,0 +1,79 @@
+package brts
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+var ErrUpgradeUnsupported = errors.New("brts: listener can not be passed to another process")
+
+// socketFile returns a duplicate of the file descriptor behind listener,
+// looking through the proxy protocol and tls wrappers.
+func socketFile(listener net.Listener) (*os.File, error) {
+	for {
+		switch l := listener.(type) {
+		case *tlsListener:
+			listener = l.Listener
+		case *proxyListener:
+			listener = l.Listener
+		case interface{ File() (*os.File, error) }:
+			return l.File()
+		default:
+			return nil, ErrUpgradeUnsupported
+		}
+	}
+}
+
+func unwrapListener(listener net.Listener) net.Listener {
+	for {
+		switch l := listener.(type) {
+		case *tlsListener:
+			listener = l.Listener
+		case *proxyListener:
+			listener = l.Listener
+		default:
+			return listener
+		}
+	}
+}
+
+// filesToListeners turns inherited socket descriptors back into listeners.
+// Stream sockets become regular listeners, datagram sockets are served as
+// UDP sessions. With unlink set, unix socket files are removed on close.
+func filesToListeners(files []*os.File, unlink bool) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(files))
+	for _, f := range files {
+		listener, err := fileListener(f, unlink)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+func fileListener(f *os.File, unlink bool) (net.Listener, error) {
+	listener, err := net.FileListener(f)
+	if err == nil {
+		if ul, ok := listener.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(unlink)
+		}
+		return listener, nil
+	}
+
+	pc, perr := net.FilePacketConn(f)
+	if perr != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, errors.New("brts: unsupported inherited socket " + f.Name())
+	}
+	return newUDPListener(conn), nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package brts
+
+import (
+	"net"
+	"os"
+)
+
+func upgradeSignals() []os.Signal {
+	return nil
+}
+
+func (s *Server) Upgrade() error {
+	return ErrUpgradeUnsupported
+}
+
+func (s *Server) inheritedListeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+func (s *Server) signalUpgradeReady() {}
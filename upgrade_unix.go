@@ -0,0 +1,140 @@
+//go:build unix
+
+package brts
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	upgradeFDsEnv  = "BRTS_UPGRADE_FDS"
+	upgradeTimeout = 30 * time.Second
+)
+
+func upgradeSignals() []os.Signal {
+	return []os.Signal{syscall.SIGUSR2}
+}
+
+// Upgrade starts a new instance of the running executable with the same
+// arguments and hands it the listening sockets. Once the new process has
+// started serving, this server drains: it stops accepting and exits after
+// the remaining clients are gone.
+func (s *Server) Upgrade() error {
+	s.mu.Lock()
+	listeners := append([]net.Listener(nil), s.listeners...)
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return errors.New("brts: server is not listening")
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := socketFile(l)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	files = append(files, readyW)
+
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), upgradeFDsEnv+"="+strconv.Itoa(len(listeners)))
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	readyW.Close()
+	go cmd.Wait()
+
+	started := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		started <- err
+	}()
+
+	select {
+	case err := <-started:
+		if err != nil {
+			return fmt.Errorf("brts: new process exited before it was ready: %v", err)
+		}
+	case <-time.After(upgradeTimeout):
+		cmd.Process.Kill()
+		return errors.New("brts: timeout waiting for the new process")
+	}
+
+	// the socket files now belong to the new process
+	for _, l := range listeners {
+		if ul, ok := unwrapListener(l).(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	s.logger.Printf("new process %d is ready, draining", cmd.Process.Pid)
+	return s.Drain()
+}
+
+func (s *Server) inheritedListeners() ([]net.Listener, error) {
+	value := os.Getenv(upgradeFDsEnv)
+	if value == "" {
+		return systemdListeners()
+	}
+	os.Unsetenv(upgradeFDsEnv)
+
+	count, err := strconv.Atoi(value)
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("brts: invalid %s value %q", upgradeFDsEnv, value)
+	}
+
+	files := make([]*os.File, count)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), "listener"+strconv.Itoa(i))
+	}
+	listeners, err := filesToListeners(files, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.upgradeReady = os.NewFile(uintptr(listenFDsStart+count), "upgrade-ready")
+	s.mu.Unlock()
+	return listeners, nil
+}
+
+// signalUpgradeReady tells the parent process that started this one through
+// Upgrade that the inherited sockets are being served.
+func (s *Server) signalUpgradeReady() {
+	s.mu.Lock()
+	ready := s.upgradeReady
+	s.upgradeReady = nil
+	s.mu.Unlock()
+
+	if ready != nil {
+		ready.Write([]byte{1})
+		ready.Close()
+	}
+}
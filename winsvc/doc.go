@@ -0,0 +1,4 @@
+// Package winsvc runs a brts.Server as a Windows service. Stop and shutdown
+// control requests shut the server down, pause drains it and continue starts
+// accepting again.
+package winsvc
@@ -0,0 +1,131 @@
+//go:build windows
+
+package winsvc
+
+import (
+	"context"
+	"time"
+
+	"github.com/avkspog/brts"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// DefaultStopTimeout bounds how long a stop request waits for clients.
+const DefaultStopTimeout = 20 * time.Second
+
+// Service specific exit codes reported to the service control manager.
+const (
+	exitStartFailed    = 1
+	exitServerFailed   = 2
+	exitShutdownFailed = 3
+)
+
+type handler struct {
+	server      *brts.Server
+	stopTimeout time.Duration
+	log         *eventlog.Log
+}
+
+// Run runs server as the named Windows service and returns once the service
+// is stopped. Signal handling should be left disabled on the server.
+// Failures are written to the application event log under the service
+// name.
+func Run(name string, server *brts.Server) error {
+	return RunWithTimeout(name, server, DefaultStopTimeout)
+}
+
+// RunWithTimeout is like Run but waits at most stopTimeout for connected
+// clients when the service is stopped.
+func RunWithTimeout(name string, server *brts.Server, stopTimeout time.Duration) error {
+	h := &handler{server: server, stopTimeout: stopTimeout}
+	if log, err := eventlog.Open(name); err == nil {
+		h.log = log
+		defer log.Close()
+	}
+	return svc.Run(name, h)
+}
+
+func (h *handler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPauseAndContinue
+
+	status <- svc.Status{State: svc.StartPending}
+	if err := h.server.StartAsync(); err != nil {
+		h.report("start", err)
+		return true, exitStartFailed
+	}
+	done := h.server.Done()
+	paused, resuming := false, false
+	status <- svc.Status{State: svc.Running, Accepts: accepted}
+
+	for {
+		select {
+		case <-done:
+			done = nil
+			if !paused {
+				if err := h.server.Wait(); err != nil {
+					h.report("serve", err)
+					return true, exitServerFailed
+				}
+				return false, 0
+			}
+			if resuming {
+				if err := h.server.StartAsync(); err != nil {
+					h.report("continue", err)
+					return true, exitStartFailed
+				}
+				done = h.server.Done()
+				paused, resuming = false, false
+				status <- svc.Status{State: svc.Running, Accepts: accepted}
+			}
+
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				ctx, cancel := context.WithTimeout(context.Background(), h.stopTimeout)
+				err := h.server.Shutdown(ctx)
+				cancel()
+				if err != nil {
+					h.report("stop", err)
+					return true, exitShutdownFailed
+				}
+				return false, 0
+
+			case svc.Pause:
+				status <- svc.Status{State: svc.PausePending}
+				if err := h.server.Drain(); err != nil {
+					h.report("pause", err)
+				}
+				paused = true
+				status <- svc.Status{State: svc.Paused, Accepts: accepted}
+
+			case svc.Continue:
+				status <- svc.Status{State: svc.ContinuePending}
+				if done != nil {
+					// Still draining: start again once the last
+					// client has left, without blocking the handler.
+					resuming = true
+					continue
+				}
+				if err := h.server.StartAsync(); err != nil {
+					h.report("continue", err)
+					return true, exitStartFailed
+				}
+				done = h.server.Done()
+				paused = false
+				status <- svc.Status{State: svc.Running, Accepts: accepted}
+			}
+		}
+	}
+}
+
+// report writes a failed control request to the event log.
+func (h *handler) report(request string, err error) {
+	if h.log != nil {
+		h.log.Error(1, request+": "+err.Error())
+	}
+}
@@ -0,0 +1,380 @@
+package brts
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultCoalesceQueue is the write queue capacity WithWriteCoalescing uses
+// when no write queue is configured.
+const defaultCoalesceQueue = 1024
+
+var (
+	ErrWriteQueueFull = errors.New("brts: write queue full")
+	ErrWriteDropped   = errors.New("brts: write dropped from full queue")
+)
+
+// QueuePolicy decides what a write does when the client's write queue is
+// full.
+type QueuePolicy int
+
+const (
+	// QueueBlock makes the writer wait until the queue has room.
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest discards the oldest queued message.
+	QueueDropOldest
+	// QueueDisconnect closes the connection and fails the write with
+	// ErrWriteQueueFull.
+	QueueDisconnect
+)
+
+// Priority orders a client's queued messages: higher priorities are
+// written first, and when the queue is full low priority messages give way.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+)
+
+const priorities = 3
+
+// lane is the index of the priority's messages in the write queue.
+func (p Priority) lane() int {
+	return min(max(int(p-PriorityLow), 0), priorities-1)
+}
+
+// writeQueue holds a client's outbound messages for its writer goroutine,
+// one lane per priority.
+type writeQueue struct {
+	mu       *sync.Mutex
+	cond     *sync.Cond
+	lanes    [priorities][][]byte
+	count    int
+	size     int
+	unsent   [][]byte
+	capacity int
+	policy   QueuePolicy
+	dropped  int
+	writing  bool
+	err      error
+	closed   chan struct{}
+	done     chan struct{}
+}
+
+func newWriteQueue(capacity int, policy QueuePolicy) *writeQueue {
+	q := &writeQueue{
+		mu:       &sync.Mutex{},
+		capacity: capacity,
+		policy:   policy,
+		closed:   make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	q.cond = sync.NewCond(q.mu)
+	return q
+}
+
+// push queues a copy of p and reports how many older messages it discarded.
+// A full queue first drops a queued message of lower priority, and a low
+// priority message is dropped itself with ErrWriteDropped. Otherwise the
+// queue's policy applies; under QueueBlock, waiting for room ends when ctx
+// does.
+func (q *writeQueue) push(ctx context.Context, p []byte, priority Priority) (dropped int, err error) {
+	if ctx.Done() != nil {
+		stop := context.AfterFunc(ctx, func() {
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		})
+		defer stop()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	lane := priority.lane()
+	for q.err == nil && q.count >= q.capacity {
+		if q.evict(lane) || q.policy == QueueDropOldest && q.evict(lane+1) {
+			dropped++
+			continue
+		}
+
+		switch {
+		case lane == 0 || q.policy == QueueDropOldest:
+			return dropped, ErrWriteDropped
+		case q.policy == QueueDisconnect:
+			q.err = ErrWriteQueueFull
+			q.cond.Broadcast()
+			return dropped, q.err
+		default:
+			if err := ctx.Err(); err != nil {
+				return dropped, err
+			}
+			q.cond.Wait()
+		}
+	}
+	if q.err != nil {
+		return dropped, q.err
+	}
+
+	q.lanes[lane] = append(q.lanes[lane], append([]byte(nil), p...))
+	q.count++
+	q.size += len(p)
+	q.cond.Broadcast()
+	return dropped, nil
+}
+
+// evict drops the oldest message of the lowest priority below lane.
+func (q *writeQueue) evict(lane int) bool {
+	for i := 0; i < lane; i++ {
+		if len(q.lanes[i]) > 0 {
+			q.size -= len(q.lanes[i][0])
+			q.lanes[i][0] = nil
+			q.lanes[i] = q.lanes[i][1:]
+			q.count--
+			q.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+// wait blocks until a message is queued. It reports false once the queue
+// is closed.
+func (q *writeQueue) wait() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.count == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	return q.err == nil
+}
+
+// pop takes the next message, and with a non-zero maxBytes the ones after
+// it as long as they fit together, highest priority first. It reports false
+// once the queue is closed.
+func (q *writeQueue) pop(batch [][]byte, maxBytes int) ([][]byte, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.count == 0 && q.err == nil {
+		q.cond.Wait()
+	}
+	if q.err != nil {
+		return batch, false
+	}
+
+	size := 0
+	for lane := priorities - 1; lane >= 0; lane-- {
+		items := q.lanes[lane]
+		n := 0
+		for _, p := range items {
+			if len(batch) > 0 && size+len(p) > maxBytes {
+				break
+			}
+			batch = append(batch, p)
+			size += len(p)
+			n++
+		}
+		clear(items[:n])
+		q.lanes[lane] = items[n:]
+		q.count -= n
+		if n < len(items) {
+			break
+		}
+	}
+	q.size -= size
+	q.writing = true
+	q.cond.Broadcast()
+	return batch, true
+}
+
+// written marks the messages taken by the last pop as written.
+func (q *writeQueue) written() {
+	q.mu.Lock()
+	q.writing = false
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// flush waits until everything queued so far is written, the queue fails
+// or ctx ends.
+func (q *writeQueue) flush(ctx context.Context) error {
+	if ctx.Done() != nil {
+		stop := context.AfterFunc(ctx, func() {
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		})
+		defer stop()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for (q.count > 0 || q.writing) && q.err == nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.cond.Wait()
+	}
+	return q.err
+}
+
+// close fails further writes with err and stops the writer, setting aside
+// what is still queued as unsent.
+func (q *writeQueue) close(err error) {
+	q.mu.Lock()
+	if q.err == nil {
+		q.err = err
+		close(q.closed)
+	}
+	for lane := priorities - 1; lane >= 0; lane-- {
+		q.unsent = append(q.unsent, q.lanes[lane]...)
+	}
+	q.lanes = [priorities][][]byte{}
+	q.count = 0
+	q.size = 0
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// startWriter gives the client a write queue and the goroutine that
+// services it, when the server has write queues enabled.
+func (s *Server) startWriter(c *Client) {
+	if s.writeQueue <= 0 {
+		return
+	}
+	q := newWriteQueue(s.writeQueue, s.queuePolicy)
+	c.mu.Lock()
+	c.queue = q
+	c.mu.Unlock()
+	go s.writeLoop(c, q)
+}
+
+func (s *Server) writeLoop(c *Client, q *writeQueue) {
+	defer close(q.done)
+
+	var batch [][]byte
+	for {
+		if s.flushDelay > 0 {
+			// Give messages queued shortly after the first a chance to
+			// share its write.
+			if !q.wait() {
+				break
+			}
+			time.Sleep(s.flushDelay)
+		}
+
+		var ok bool
+		batch, ok = q.pop(batch[:0], s.coalesceSize)
+		if !ok {
+			break
+		}
+		err := c.writeBatch(q.closed, batch)
+		clear(batch)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !s.quitting() {
+				s.logger.Printf("write to %v failed: %v", c.Conn.RemoteAddr(), err)
+			}
+			q.close(err)
+			q.written()
+			c.writeFailed(err)
+			break
+		}
+		q.written()
+	}
+
+	q.mu.Lock()
+	full := q.err == ErrWriteQueueFull
+	q.mu.Unlock()
+	if full {
+		s.logger.Printf("write queue full: %v", c.Conn.RemoteAddr())
+	}
+}
+
+// writeBatch writes queued messages with a single write: one writev on
+// plain sockets, a joined buffer otherwise. Waiting for the write rate
+// ends when quit is closed.
+func (c *Client) writeBatch(quit <-chan struct{}, batch [][]byte) error {
+	size := 0
+	for _, p := range batch {
+		size += len(p)
+	}
+	if !c.throttle(quit, size, len(batch)) {
+		return net.ErrClosed
+	}
+
+	if len(batch) == 1 {
+		_, err := c.writeConn(context.Background(), batch[0])
+		return err
+	}
+
+	conn, _, _ := c.beginWrite(context.Background())
+	var n int64
+	var err error
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		bufs := net.Buffers(batch)
+		n, err = bufs.WriteTo(conn)
+	default:
+		var w int
+		w, err = conn.Write(bytes.Join(batch, nil))
+		n = int64(w)
+	}
+	return c.endWrite(context.Background(), nil, n, len(batch), err)
+}
+
+// Flush waits until the messages queued for the client are written, or
+// until ctx ends. It also waits for a write in progress without a queue.
+// The error is the one that stopped the writer, if it stopped.
+func (c *Client) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	q := c.queue
+	c.mu.Unlock()
+	if q != nil {
+		return q.flush(ctx)
+	}
+
+	select {
+	case c.writeLock <- struct{}{}:
+		<-c.writeLock
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stopWriter closes the client's write queue, waits for its writer and
+// returns the messages that were not written.
+func (c *Client) stopWriter() [][]byte {
+	c.mu.Lock()
+	q := c.queue
+	c.mu.Unlock()
+	if q == nil {
+		return nil
+	}
+	q.close(net.ErrClosed)
+	<-q.done
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.unsent
+}
+
+// DroppedWrites reports how many queued messages were discarded under
+// QueueDropOldest.
+func (c *Client) DroppedWrites() int {
+	c.mu.Lock()
+	q := c.queue
+	c.mu.Unlock()
+	if q == nil {
+		return 0
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
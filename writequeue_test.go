@@ -0,0 +1,168 @@
+package brts
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func pushAll(t *testing.T, q *writeQueue, msgs ...string) int {
+	t.Helper()
+	dropped := 0
+	for _, m := range msgs {
+		n, err := q.push(context.Background(), []byte(m), PriorityNormal)
+		if err != nil {
+			t.Fatalf("push %q: %v", m, err)
+		}
+		dropped += n
+	}
+	return dropped
+}
+
+func popOne(t *testing.T, q *writeQueue) string {
+	t.Helper()
+	batch, ok := q.pop(nil, 0)
+	if !ok || len(batch) != 1 {
+		t.Fatalf("pop returned %q, %v", batch, ok)
+	}
+	q.written()
+	return string(batch[0])
+}
+
+func TestWriteQueueDropOldest(t *testing.T) {
+	q := newWriteQueue(2, QueueDropOldest)
+	if dropped := pushAll(t, q, "a", "b", "c"); dropped != 1 {
+		t.Fatalf("dropped %d messages, want 1", dropped)
+	}
+	for _, want := range []string{"b", "c"} {
+		if got := popOne(t, q); got != want {
+			t.Fatalf("popped %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWriteQueuePriority(t *testing.T) {
+	q := newWriteQueue(2, QueueBlock)
+	q.push(context.Background(), []byte("low"), PriorityLow)
+	q.push(context.Background(), []byte("normal"), PriorityNormal)
+	dropped, err := q.push(context.Background(), []byte("high"), PriorityHigh)
+	if err != nil || dropped != 1 {
+		t.Fatalf("push high: dropped %d, %v; want the low priority message dropped", dropped, err)
+	}
+	if _, err := q.push(context.Background(), []byte("low"), PriorityLow); err != ErrWriteDropped {
+		t.Fatalf("push low into full queue: %v, want ErrWriteDropped", err)
+	}
+	for _, want := range []string{"high", "normal"} {
+		if got := popOne(t, q); got != want {
+			t.Fatalf("popped %q, want %q", got, want)
+		}
+	}
+}
+
+func TestWriteQueueBlock(t *testing.T) {
+	q := newWriteQueue(1, QueueBlock)
+	pushAll(t, q, "a")
+	pushed := make(chan error, 1)
+	go func() {
+		_, err := q.push(context.Background(), []byte("b"), PriorityNormal)
+		pushed <- err
+	}()
+
+	select {
+	case err := <-pushed:
+		t.Fatalf("push into full queue returned %v without waiting", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if got := popOne(t, q); got != "a" {
+		t.Fatalf("popped %q, want \"a\"", got)
+	}
+	if err := receive(t, pushed); err != nil {
+		t.Fatalf("blocked push: %v", err)
+	}
+}
+
+func TestWriteQueueBlockHonoursContext(t *testing.T) {
+	q := newWriteQueue(1, QueueBlock)
+	pushAll(t, q, "a")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := q.push(ctx, []byte("b"), PriorityNormal); err != context.DeadlineExceeded {
+		t.Fatalf("push into full queue: %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestWriteQueueDisconnect(t *testing.T) {
+	q := newWriteQueue(1, QueueDisconnect)
+	pushAll(t, q, "a")
+	if _, err := q.push(context.Background(), []byte("b"), PriorityNormal); err != ErrWriteQueueFull {
+		t.Fatalf("push into full queue: %v, want ErrWriteQueueFull", err)
+	}
+	if _, ok := q.pop(nil, 0); ok {
+		t.Fatal("pop succeeded on a failed queue")
+	}
+}
+
+func TestWriteQueueCoalesces(t *testing.T) {
+	q := newWriteQueue(4, QueueBlock)
+	pushAll(t, q, "aa", "bb", "cc")
+	batch, ok := q.pop(nil, 4)
+	if !ok || len(batch) != 2 || string(batch[0]) != "aa" || string(batch[1]) != "bb" {
+		t.Fatalf("pop returned %q, %v; want the messages fitting in 4 bytes", batch, ok)
+	}
+	if got := popOne(t, q); got != "cc" {
+		t.Fatalf("popped %q, want \"cc\"", got)
+	}
+}
+
+func TestWriteQueueFlush(t *testing.T) {
+	q := newWriteQueue(2, QueueBlock)
+	pushAll(t, q, "a")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := q.flush(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("flush with a message queued: %v, want context.DeadlineExceeded", err)
+	}
+
+	batch, _ := q.pop(nil, 0)
+	flushed := make(chan error, 1)
+	go func() { flushed <- q.flush(context.Background()) }()
+	select {
+	case err := <-flushed:
+		t.Fatalf("flush returned %v while %q was being written", err, batch)
+	case <-time.After(20 * time.Millisecond):
+	}
+	q.written()
+	if err := receive(t, flushed); err != nil {
+		t.Fatalf("flush: %v", err)
+	}
+}
+
+func TestWriteQueueDeliversInOrder(t *testing.T) {
+	s := newServer(t, WithWriteQueue(8, QueueBlock))
+	connected := make(chan *Client, 1)
+	s.OnNewConnection(func(c *Client) { connected <- c })
+	start(t, s)
+
+	conn := dial(t, s)
+	c := receive(t, connected)
+	sent := make(chan error, 1)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if err := c.Send([]byte(fmt.Sprint("message ", i))); err != nil {
+				sent <- err
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		sent <- c.Flush(ctx)
+	}()
+
+	for i := 0; i < 100; i++ {
+		conn.expect(t, fmt.Sprint("message ", i))
+	}
+	if err := receive(t, sent); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}